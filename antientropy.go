@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+)
+
+const (
+	defaultAntiEntropyInterval = 10 * time.Second
+	defaultTombstoneTTL        = 24 * time.Hour
+)
+
+// AntiEntropyOpts controls how replicas that missed a store or delete
+// catch up
+type AntiEntropyOpts struct {
+	// Interval is how often a node compares the objects it shares with a
+	// random peer
+	Interval time.Duration
+	// TombstoneTTL is how long a delete is remembered; a replica offline
+	// for longer may bring the object back
+	TombstoneTTL time.Duration
+}
+
+// MessageSyncTree asks a peer for nodes of the Merkle tree over the
+// objects both of them own. The answer carries the hashes of the nodes
+// on Level, or with Entries, the entries of the leaves.
+type MessageSyncTree struct {
+	RequestID uint64
+	Level     int
+	Nodes     []int
+	Entries   bool
+}
+
+// antiEntropyLoop syncs with a random peer once per interval and forgets
+// expired tombstones
+func (s *FileServer) antiEntropyLoop() {
+	ticker := time.NewTicker(s.AntiEntropy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if peers := s.peerList(); len(peers) > 0 {
+				peer := peers[rand.IntN(len(peers))]
+				if err := s.syncWith(context.Background(), peer); err != nil {
+					log.Printf("[%s] syncing with (%s): %v", s.Transport.Addr(), p2p.PeerID(peer), err)
+				}
+			}
+			if err := s.purgeTombstones(); err != nil {
+				log.Printf("[%s] %v", s.Transport.Addr(), err)
+			}
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// placedOn reports whether ring places the replicas of the object stored
+// under id and key on all the given nodes
+func (s *FileServer) placedOn(ring *HashRing, id, key string, nodes ...string) bool {
+	// This node's own objects are not placed by the ring
+	if id == s.ID {
+		return false
+	}
+	owners := ring.Owners(objectKadID(id, key), s.ReplicationFactor, id)
+	for _, node := range nodes {
+		if !slices.Contains(owners, node) {
+			return false
+		}
+	}
+	return true
+}
+
+// syncEntries returns the versions of the replicas and tombstones this
+// node holds for objects the ring places on both it and peer
+func (s *FileServer) syncEntries(peer string) ([]SyncEntry, error) {
+	ring := s.currentRing()
+	self := s.nodeID()
+	shared := func(id, key string) bool {
+		return s.placedOn(ring, id, key, self, peer)
+	}
+
+	refs, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	tombstones, err := s.store.Tombstones()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[ObjectRef]SyncEntry{}
+	for _, ref := range refs {
+		if !shared(ref.ID, ref.Key) {
+			continue
+		}
+		meta, err := s.store.ReadMeta(ref.ID, ref.Key)
+		if err != nil || meta.Provenance == nil {
+			continue
+		}
+		entries[ref] = SyncEntry{
+			ID:        ref.ID,
+			Key:       ref.Key,
+			Timestamp: meta.Provenance.Timestamp,
+			Hash:      meta.Provenance.Hash,
+			Author:    meta.Provenance.Author,
+		}
+	}
+	for _, t := range tombstones {
+		ref := ObjectRef{ID: t.ID, Key: t.Key}
+		if !shared(ref.ID, ref.Key) {
+			continue
+		}
+		e := SyncEntry{
+			ID:        t.ID,
+			Key:       t.Key,
+			Timestamp: t.Timestamp,
+			Author:    t.Author,
+			Deleted:   true,
+			Secure:    t.Secure,
+			Signature: t.Signature,
+		}
+		if old, ok := entries[ref]; !ok || e.newer(old) {
+			entries[ref] = e
+		}
+	}
+
+	list := make([]SyncEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// syncWith compares the Merkle trees this node and peer build over the
+// objects they share, descending only into the subtrees that differ, and
+// reconciles the objects of the leaves that do
+func (s *FileServer) syncWith(ctx context.Context, peer p2p.Peer) error {
+	entries, err := s.syncEntries(p2p.PeerID(peer))
+	if err != nil {
+		return err
+	}
+	local := NewMerkleTree(entries)
+
+	nodes := []int{0}
+	for level := 0; ; level++ {
+		resp, err := s.requestSync(ctx, peer, MessageSyncTree{Level: level, Nodes: nodes})
+		if err != nil {
+			return err
+		}
+		if len(resp.Hashes) != len(nodes) {
+			return fmt.Errorf("peer sent %d hashes for %d nodes", len(resp.Hashes), len(nodes))
+		}
+
+		differing := []int{}
+		for i, n := range nodes {
+			if !bytes.Equal(local.Hash(level, n), resp.Hashes[i]) {
+				differing = append(differing, n)
+			}
+		}
+		if len(differing) == 0 {
+			return nil
+		}
+		if level == merkleDepth {
+			nodes = differing
+			break
+		}
+		nodes = merkleChildren(differing)
+	}
+
+	resp, err := s.requestSync(ctx, peer, MessageSyncTree{Level: merkleDepth, Nodes: nodes, Entries: true})
+	if err != nil {
+		return err
+	}
+
+	mine := []SyncEntry{}
+	for _, n := range nodes {
+		mine = append(mine, local.Bucket(n)...)
+	}
+	s.reconcile(ctx, peer, mine, resp.Entries)
+
+	return nil
+}
+
+// requestSync sends a Merkle tree request to peer and waits for the
+// answer
+func (s *FileServer) requestSync(ctx context.Context, peer p2p.Peer, msg MessageSyncTree) (MessageResponse, error) {
+	response := make(chan MessageResponse, 1)
+	msg.RequestID = s.expectResponse(peer, response)
+
+	if err := s.send(peer, &Message{Payload: msg}); err != nil {
+		s.forgetResponse(msg.RequestID)
+		return MessageResponse{}, err
+	}
+
+	resp, err := s.awaitResponse(ctx, msg.RequestID, response)
+	if err != nil {
+		return resp, err
+	}
+	return resp, resp.Err()
+}
+
+// reconcile brings this node and peer to the newest version of every
+// object in the leaves they disagree on: this node pulls what peer has
+// newer and pushes what it has newer itself, deletions included
+func (s *FileServer) reconcile(ctx context.Context, peer p2p.Peer, mine, theirs []SyncEntry) {
+	local := map[ObjectRef]SyncEntry{}
+	for _, e := range mine {
+		local[ObjectRef{ID: e.ID, Key: e.Key}] = e
+	}
+	remote := map[ObjectRef]SyncEntry{}
+	for _, e := range theirs {
+		remote[ObjectRef{ID: e.ID, Key: e.Key}] = e
+	}
+
+	ring := s.currentRing()
+	self := s.nodeID()
+	for ref, e := range remote {
+		if old, ok := local[ref]; ok && !e.newer(old) {
+			continue
+		}
+		// A peer may list objects this node does not keep a replica of
+		if !s.placedOn(ring, ref.ID, ref.Key, self) {
+			continue
+		}
+		if err := s.pull(ctx, peer, e); err != nil {
+			log.Printf("[%s] pulling (%s) from (%s): %v", s.Transport.Addr(), ref.Key, p2p.PeerID(peer), err)
+		}
+	}
+
+	contact := Contact{ID: p2p.PeerID(peer), Addr: listenAddr(peer)}
+	for ref, e := range local {
+		if old, ok := remote[ref]; ok && !e.newer(old) {
+			continue
+		}
+		if err := s.push(peer, contact, e); err != nil {
+			log.Printf("[%s] pushing (%s) to (%s): %v", s.Transport.Addr(), ref.Key, p2p.PeerID(peer), err)
+		}
+	}
+}
+
+// pull takes the version of an object a peer has newer
+func (s *FileServer) pull(ctx context.Context, peer p2p.Peer, e SyncEntry) error {
+	if e.Deleted {
+		deleted, err := s.applyTombstone(e.tombstone())
+		if deleted {
+			s.dht.RemoveProviders(objectKadID(e.ID, e.Key))
+			fmt.Printf("[%s] deleted file (%s) missed earlier\n", s.Transport.Addr(), e.Key)
+		}
+		return err
+	}
+
+	// The author is the peer's claim; only the owner may have signed it
+	if p2p.NodeIDFromKey(e.Author) != e.ID {
+		return fmt.Errorf("%w: object was not signed by its owner", ErrInvalidProvenance)
+	}
+
+	data, prov, err := s.fetchFrom(ctx, []p2p.Peer{peer}, e.ID, e.Key, e.Author)
+	if err != nil {
+		return err
+	}
+	if _, _, err := s.storeReplica(e.ID, e.Key, *prov, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	s.announce(ctx, e.ID, e.Key, []Contact{s.self()})
+	return nil
+}
+
+// push sends peer the version of an object this node has newer
+func (s *FileServer) push(peer p2p.Peer, contact Contact, e SyncEntry) error {
+	if e.Deleted {
+		t := e.tombstone()
+		if err := t.Verify(); err != nil {
+			return err
+		}
+		return s.send(peer, &Message{Payload: MessageDeleteFile{Tombstone: t}})
+	}
+
+	return s.handoff(ObjectRef{ID: e.ID, Key: e.Key}, []Contact{contact})
+}
+
+// handleMessageSyncTree answers with nodes of the Merkle tree over the
+// objects this node shares with the peer asking
+func (s *FileServer) handleMessageSyncTree(from string, msg MessageSyncTree) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	entries, err := s.syncEntries(from)
+	if err != nil {
+		s.sendResponse(peer, msg.RequestID, 0, err)
+		return err
+	}
+	tree := NewMerkleTree(entries)
+
+	resp := newResponse(msg.RequestID, 0, nil)
+	for _, n := range msg.Nodes {
+		if msg.Entries {
+			resp.Entries = append(resp.Entries, tree.Bucket(n)...)
+		} else {
+			resp.Hashes = append(resp.Hashes, tree.Hash(msg.Level, n))
+		}
+	}
+	return s.send(peer, &Message{Payload: resp})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startSettledCluster starts a cluster and waits until every node has
+// the whole ring and has rebalanced for it, so only anti-entropy moves
+// replicas afterwards
+func startSettledCluster(t *testing.T, n int) []*FileServer {
+	servers := startCluster(t, n, nil)
+	waitForCluster(t, len(servers), func() bool {
+		for _, s := range servers {
+			if len(s.currentRing().Nodes()) != n {
+				return false
+			}
+		}
+		return true
+	}, "every node should see the whole ring")
+	time.Sleep(2 * servers[0].members.ProbeInterval)
+
+	return servers
+}
+
+func TestAntiEntropyCatchesUpMissedStore(t *testing.T) {
+	servers := startSettledCluster(t, 4)
+	s := servers[0]
+	name := s.hashObjectKey("missed")
+
+	s.WriteConsistency = ConsistencyAll
+	data := []byte("stored while a replica was away")
+	assert.NoError(t, s.Store("missed", bytes.NewReader(data)), "Store should not error")
+
+	// The owner lost the replica, as if it had been offline
+	away := servers[3]
+	assert.NoError(t, away.store.Delete(s.ID, name), "Deleting a replica should not error")
+
+	waitForCluster(t, len(servers), func() bool {
+		return away.store.Has(s.ID, name)
+	}, "replica should come back through anti-entropy")
+
+	meta, err := away.store.ReadMeta(s.ID, name)
+	assert.NoError(t, err, "Reading the synced metadata should not error")
+	_, r, err := away.store.Read(s.ID, name)
+	assert.NoError(t, err, "Reading the synced replica should not error")
+	got, err := io.ReadAll(r)
+	r.Close()
+	assert.NoError(t, err, "Reading the synced replica should not error")
+	assert.Equal(t, int64(len(got)), meta.Provenance.Size, "Synced replica should match its provenance")
+}
+
+func TestAntiEntropyCatchesUpMissedDelete(t *testing.T) {
+	servers := startSettledCluster(t, 4)
+	s := servers[0]
+	name := s.hashObjectKey("deleted")
+
+	s.WriteConsistency = ConsistencyAll
+	assert.NoError(t, s.Store("deleted", bytes.NewReader([]byte("to be deleted"))), "Store should not error")
+
+	// Keep one owner's replica to put back, as if it missed the delete
+	away := servers[3]
+	meta, err := away.store.ReadMeta(s.ID, name)
+	assert.NoError(t, err, "Reading the metadata should not error")
+	_, r, err := away.store.Read(s.ID, name)
+	assert.NoError(t, err, "Reading the replica should not error")
+	replica, err := io.ReadAll(r)
+	r.Close()
+	assert.NoError(t, err, "Reading the replica should not error")
+
+	assert.NoError(t, s.Delete("deleted"), "Delete should not error")
+	assertReplicas(t, s, "deleted", false, servers[1:]...)
+
+	_, err = away.store.Write(s.ID, name, bytes.NewReader(replica))
+	assert.NoError(t, err, "Restoring the replica should not error")
+	assert.NoError(t, away.store.WriteMeta(s.ID, name, meta), "Restoring the metadata should not error")
+	assert.NoError(t, away.store.DeleteTombstone(s.ID, name), "Forgetting the delete should not error")
+
+	waitForCluster(t, len(servers), func() bool {
+		return !away.store.Has(s.ID, name)
+	}, "missed delete should be applied through anti-entropy")
+
+	// The other owners kept their tombstones and did not take it back
+	for _, owner := range servers[1:3] {
+		assert.False(t, owner.store.Has(s.ID, name), "Owner should not get the deleted replica back")
+		_, err := owner.store.ReadTombstone(s.ID, name)
+		assert.NoError(t, err, "Owner should keep the tombstone")
+	}
+}
+
+func TestAntiEntropyRejectsForeignEntries(t *testing.T) {
+	servers := startSettledCluster(t, 5)
+	s := servers[0]
+	name := s.hashObjectKey("placed")
+
+	s.WriteConsistency = ConsistencyAll
+	assert.NoError(t, s.Store("placed", bytes.NewReader([]byte("kept by the owners"))), "Store should not error")
+	owners := ringOwners(s, "placed", servers)
+	meta, err := owners[0].store.ReadMeta(s.ID, name)
+	assert.NoError(t, err, "Reading the metadata should not error")
+	entry := SyncEntry{
+		ID:        s.ID,
+		Key:       name,
+		Timestamp: meta.Provenance.Timestamp,
+		Hash:      meta.Provenance.Hash,
+		Author:    meta.Provenance.Author,
+	}
+
+	// A node the ring does not place the object on leaves it alone
+	var outsider *FileServer
+	for _, other := range servers[1:] {
+		if !slices.Contains(owners, other) {
+			outsider = other
+		}
+	}
+	peer, ok := outsider.peer(owners[0].nodeID())
+	assert.True(t, ok, "Outsider should be connected to the owner")
+	outsider.reconcile(context.Background(), peer, nil, []SyncEntry{entry})
+	assert.False(t, outsider.store.Has(s.ID, name), "Outsider should not pull a replica it does not own")
+
+	// An owner does not take the author a peer advertises
+	forged := entry
+	forged.Author = outsider.IdentityKey.Public().(ed25519.PublicKey)
+	holder := owners[1]
+	peer, ok = holder.peer(owners[0].nodeID())
+	assert.True(t, ok, "Owners should be connected")
+	err = holder.pull(context.Background(), peer, forged)
+	assert.ErrorIs(t, err, ErrInvalidProvenance, "Entry not signed by the owner should not be pulled")
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+)
+
+const (
+	defaultMinBackoff     = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+	defaultConnectTimeout = 10 * time.Second
+)
+
+// errConnectTimeout is recorded when a dial never turns into a peer,
+// for example because the handshake failed
+var errConnectTimeout = errors.New("peer did not complete the handshake in time")
+
+// ConnState is the state of the connection to a desired peer
+type ConnState int
+
+const (
+	ConnDisconnected ConnState = iota
+	ConnConnecting
+	ConnConnected
+	// ConnBackoff means the last attempt failed and the next one waits
+	ConnBackoff
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnecting:
+		return "connecting"
+	case ConnConnected:
+		return "connected"
+	case ConnBackoff:
+		return "backoff"
+	}
+	return "disconnected"
+}
+
+// ConnStatus describes the connection to a desired peer
+type ConnStatus struct {
+	Addr  string
+	State ConnState
+	// PeerID is the node ID of the peer while it is connected
+	PeerID         string
+	ConnectedSince time.Time
+	// Attempts counts the failed attempts since the last connection
+	Attempts    int
+	LastError   error
+	NextAttempt time.Time
+}
+
+// ConnManagerOpts configures how a ConnManager retries
+type ConnManagerOpts struct {
+	// MinBackoff is the delay after the first failed attempt. It doubles
+	// with every further failure up to MaxBackoff, and each delay is
+	// randomised between half and all of it so nodes do not retry in step.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ConnectTimeout bounds how long a dial may take to become a peer
+	ConnectTimeout time.Duration
+}
+
+// ConnManager keeps a set of addresses connected, redialing them with
+// exponential backoff whenever the connection is lost or cannot be made.
+// It learns about connections through Connected and Disconnected, which
+// the owner calls from the transport's OnPeer and OnPeerDisconnect.
+type ConnManager struct {
+	ConnManagerOpts
+
+	transport p2p.Transport
+
+	mu      sync.Mutex
+	entries map[string]*connEntry
+	started bool
+	quitch  chan struct{}
+}
+
+// connEntry is the connection state of one desired address
+type connEntry struct {
+	status ConnStatus
+	peer   p2p.Peer
+	// changed is closed and replaced whenever the state changes
+	changed chan struct{}
+	removed chan struct{}
+}
+
+// NewConnManager creates a connection manager dialing over transport
+func NewConnManager(transport p2p.Transport, opts ConnManagerOpts) *ConnManager {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultMaxBackoff, opts.MinBackoff)
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = defaultConnectTimeout
+	}
+
+	return &ConnManager{
+		ConnManagerOpts: opts,
+		transport:       transport,
+		entries:         make(map[string]*connEntry),
+		quitch:          make(chan struct{}),
+	}
+}
+
+// Add asks the manager to keep addr connected
+func (m *ConnManager) Add(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[addr]; ok {
+		return
+	}
+
+	e := &connEntry{
+		status:  ConnStatus{Addr: addr},
+		changed: make(chan struct{}),
+		removed: make(chan struct{}),
+	}
+	m.entries[addr] = e
+
+	if m.started {
+		go m.maintain(e)
+	}
+}
+
+// Remove stops keeping addr connected. An open connection is left alone.
+func (m *ConnManager) Remove(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[addr]; ok {
+		close(e.removed)
+		delete(m.entries, addr)
+	}
+}
+
+// Start begins connecting to every added address
+func (m *ConnManager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.started {
+		return
+	}
+	m.started = true
+
+	for _, e := range m.entries {
+		go m.maintain(e)
+	}
+}
+
+// Stop stops all reconnection attempts
+func (m *ConnManager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.quitch:
+	default:
+		close(m.quitch)
+	}
+}
+
+// Connected records a new peer, which satisfies the address it listens
+// on whichever side dialed
+func (m *ConnManager) Connected(p p2p.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entry(p)
+	if !ok {
+		return
+	}
+
+	e.peer = p
+	e.status.State = ConnConnected
+	e.status.PeerID = p2p.PeerID(p)
+	e.status.ConnectedSince = time.Now()
+	e.status.Attempts = 0
+	e.status.LastError = nil
+	e.status.NextAttempt = time.Time{}
+	e.signal()
+}
+
+// Disconnected records that the connection to a peer is gone
+func (m *ConnManager) Disconnected(p p2p.Peer, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entry(p)
+	if !ok || e.peer != p {
+		return
+	}
+
+	e.peer = nil
+	e.status.State = ConnDisconnected
+	e.status.PeerID = ""
+	e.status.ConnectedSince = time.Time{}
+	e.status.LastError = err
+	e.signal()
+}
+
+// Status returns the connection state of a desired address
+func (m *ConnManager) Status(addr string) (ConnStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[addr]
+	if !ok {
+		return ConnStatus{}, false
+	}
+	return e.status, true
+}
+
+// Statuses returns the connection state of every desired address,
+// sorted by address
+func (m *ConnManager) Statuses() []ConnStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]ConnStatus, 0, len(m.entries))
+	for _, e := range m.entries {
+		statuses = append(statuses, e.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Addr < statuses[j].Addr
+	})
+
+	return statuses
+}
+
+// maintain dials an address whenever it is not connected, until it is
+// removed or the manager stops
+func (m *ConnManager) maintain(e *connEntry) {
+	for {
+		m.mu.Lock()
+		for e.status.State == ConnConnected {
+			if !m.wait(e, nil) {
+				m.mu.Unlock()
+				return
+			}
+		}
+		e.status.State = ConnConnecting
+		e.signal()
+		changed := e.changed
+		m.mu.Unlock()
+
+		err := m.transport.Dial(e.status.Addr)
+		if err == nil {
+			select {
+			case <-changed:
+			case <-time.After(m.ConnectTimeout):
+				err = errConnectTimeout
+			case <-m.quitch:
+				return
+			case <-e.removed:
+				return
+			}
+		}
+
+		m.mu.Lock()
+		if e.status.State == ConnConnected {
+			m.mu.Unlock()
+			continue
+		}
+		if err == nil {
+			err = e.status.LastError
+		}
+
+		e.status.Attempts++
+		e.status.LastError = err
+		delay := backoff(m.MinBackoff, m.MaxBackoff, e.status.Attempts)
+		e.status.State = ConnBackoff
+		e.status.NextAttempt = time.Now().Add(delay)
+		e.signal()
+
+		log.Printf("[%s] connecting to %s failed (attempt %d), retrying in %s: %v", m.transport.Addr(), e.status.Addr, e.status.Attempts, delay.Round(time.Millisecond), err)
+
+		// An inbound connection from the address ends the wait early
+		timer := time.NewTimer(delay)
+		ok := m.wait(e, timer.C)
+		timer.Stop()
+		m.mu.Unlock()
+		if !ok {
+			return
+		}
+	}
+}
+
+// wait releases m.mu until the entry changes or timeout fires, and
+// reports false when the entry should no longer be maintained
+func (m *ConnManager) wait(e *connEntry, timeout <-chan time.Time) bool {
+	changed := e.changed
+	m.mu.Unlock()
+	defer m.mu.Lock()
+
+	select {
+	case <-changed:
+	case <-timeout:
+	case <-m.quitch:
+		return false
+	case <-e.removed:
+		return false
+	}
+	return true
+}
+
+// signal wakes up the entry's goroutine; m.mu must be held
+func (e *connEntry) signal() {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// backoff returns the randomised delay before the given attempt
+func backoff(minDelay, maxDelay time.Duration, attempt int) time.Duration {
+	d := minDelay
+	for i := 1; i < attempt && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// entry returns the entry of the desired address a peer listens on;
+// m.mu must be held
+func (m *ConnManager) entry(p p2p.Peer) (*connEntry, bool) {
+	addr := listenAddr(p)
+	if e, ok := m.entries[addr]; ok {
+		return e, true
+	}
+	for desired, e := range m.entries {
+		if sameAddr(desired, addr) {
+			return e, true
+		}
+	}
+	return nil, false
+}
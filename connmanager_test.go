@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	minDelay, maxDelay := 100*time.Millisecond, time.Second
+
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, want := range expected {
+		want *= time.Millisecond
+		for range 20 {
+			d := backoff(minDelay, maxDelay, i+1)
+			assert.GreaterOrEqual(t, d, want/2, "Jitter should keep at least half of the delay")
+			assert.LessOrEqual(t, d, want, "Delay should double per attempt up to the maximum")
+		}
+	}
+}
+
+func TestConnManagerReconnects(t *testing.T) {
+	network := p2p.NewMemoryNetwork()
+	faults := p2p.NewFaultInjector(1)
+
+	// node1 starts before its bootstrap node exists
+	s1 := newMemoryServer(t, network, faults, "node1", "node0")
+	s1.conns.MinBackoff = 10 * time.Millisecond
+	s1.conns.MaxBackoff = 50 * time.Millisecond
+	assert.NoError(t, s1.Transport.ListenAndAccept(), "Listening should not error")
+	s1.bootstrapNetwork()
+
+	status := func() ConnStatus {
+		st, ok := s1.conns.Status("node0")
+		assert.True(t, ok, "Bootstrap node should be tracked")
+		return st
+	}
+
+	waitFor(t, func() bool {
+		return status().Attempts >= 2
+	}, "unreachable bootstrap node should be retried")
+	assert.ErrorIs(t, status().LastError, p2p.ErrConnRefused, "Last error should be recorded")
+
+	s0 := newMemoryServer(t, network, faults, "node0")
+	assert.NoError(t, s0.Transport.ListenAndAccept(), "Listening should not error")
+
+	waitFor(t, func() bool {
+		return status().State == ConnConnected
+	}, "bootstrap node should be connected once it is up")
+	assert.Equal(t, s0.ID, status().PeerID, "Status should name the connected node")
+	assert.Zero(t, status().Attempts, "Attempts should reset after connecting")
+
+	// Cut the link; the manager keeps retrying until the partition heals
+	faults.Partition("split", "node1")
+	waitFor(t, func() bool {
+		return status().State != ConnConnected && status().Attempts > 0
+	}, "lost connection should be noticed and retried")
+
+	faults.Heal("split")
+	waitFor(t, func() bool {
+		return status().State == ConnConnected
+	}, "connection should come back after the partition heals")
+
+	assert.Len(t, s1.Connections(), 1, "Only bootstrap nodes should be listed")
+}
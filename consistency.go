@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrWriteConsistency is returned by a store that fewer owners
+// acknowledged than its consistency level needs
+var ErrWriteConsistency = errors.New("write consistency not reached")
+
+// ConsistencyLevel is how many of the owners of an object must take part
+// in an operation for it to succeed
+type ConsistencyLevel uint8
+
+const (
+	// ConsistencyOne needs a single owner
+	ConsistencyOne ConsistencyLevel = iota + 1
+	// ConsistencyQuorum needs a majority of the owners
+	ConsistencyQuorum
+	// ConsistencyAll needs every owner
+	ConsistencyAll
+)
+
+func (l ConsistencyLevel) String() string {
+	switch l {
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	default:
+		return fmt.Sprintf("consistency(%d)", l)
+	}
+}
+
+// required returns how many of n owners the level needs. A cluster with
+// fewer nodes than the replication factor has fewer owners, and the level
+// applies to the ones it has.
+func (l ConsistencyLevel) required(n int) int {
+	switch l {
+	case ConsistencyOne:
+		return min(1, n)
+	case ConsistencyAll:
+		return n
+	default:
+		if n == 0 {
+			return 0
+		}
+		return n/2 + 1
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsistencyRequired(t *testing.T) {
+	tests := []struct {
+		level  ConsistencyLevel
+		owners int
+		want   int
+	}{
+		{ConsistencyOne, 3, 1},
+		{ConsistencyQuorum, 3, 2},
+		{ConsistencyQuorum, 4, 3},
+		{ConsistencyAll, 3, 3},
+		{ConsistencyOne, 0, 0},
+		{ConsistencyQuorum, 0, 0},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.level.required(tt.owners), "%s of %d owners", tt.level, tt.owners)
+	}
+}
+
+func TestStoreWaitsForWriteConsistency(t *testing.T) {
+	faults := p2p.NewFaultInjector(1)
+	servers := startCluster(t, 4, faults)
+	s, hung := servers[0], servers[3]
+
+	// Every other node owns the replicas; one of them never answers in time
+	faults.SetNodeFaults(hung.Transport.Addr(), p2p.Faults{Latency: 10 * time.Second})
+
+	s.WriteConsistency = ConsistencyAll
+	err := s.Store("all", bytes.NewReader([]byte("needs every owner")))
+	assert.ErrorIs(t, err, ErrWriteConsistency, "Store should fail when an owner does not acknowledge")
+	assert.True(t, s.store.Has(s.ID, "all"), "Store should keep the local copy")
+
+	s.WriteConsistency = ConsistencyQuorum
+	start := time.Now()
+	assert.NoError(t, s.Store("quorum", bytes.NewReader([]byte("needs most owners"))), "Store should not error with a quorum")
+	assert.Less(t, time.Since(start), s.RequestTimeout, "Store should not wait for the hung owner")
+	for _, owner := range servers[1:3] {
+		assert.True(t, owner.store.Has(s.ID, s.hashObjectKey("quorum")), "Acknowledging owner should hold the replica")
+	}
+}
+
+func TestStoreDoesNotCountSupersededReplicas(t *testing.T) {
+	servers := startCluster(t, 4, nil)
+	s, victim := servers[0], servers[3]
+	name := s.hashObjectKey("contested")
+
+	s.WriteConsistency = ConsistencyAll
+	assert.NoError(t, s.Store("contested", bytes.NewReader([]byte("first version"))), "Store should not error")
+
+	// One owner claims to hold a version newer than the next one
+	meta, err := victim.store.ReadMeta(s.ID, name)
+	assert.NoError(t, err, "Reading the metadata should not error")
+	newer := *meta.Provenance
+	newer.Timestamp = time.Now().Add(time.Hour).UnixNano()
+	assert.NoError(t, victim.store.WriteMeta(s.ID, name, ObjectMeta{Provenance: &newer}), "Writing the metadata should not error")
+
+	err = s.Store("contested", bytes.NewReader([]byte("second version")))
+	assert.ErrorIs(t, err, ErrWriteConsistency, "Superseded owner should not count as a written replica")
+
+	s.WriteConsistency = ConsistencyQuorum
+	assert.NoError(t, s.Store("contested", bytes.NewReader([]byte("third version"))), "Store should not error with a quorum")
+}
+
+func TestGetRepairsStaleReplicas(t *testing.T) {
+	servers := startCluster(t, 4, nil)
+	s := servers[0]
+	name := s.hashObjectKey("versioned")
+
+	s.WriteConsistency = ConsistencyAll
+	assert.NoError(t, s.Store("versioned", bytes.NewReader([]byte("old version"))), "Store should not error")
+
+	// Keep the old replica of one owner to put back later
+	stale := servers[3]
+	meta, err := stale.store.ReadMeta(s.ID, name)
+	assert.NoError(t, err, "Reading the old metadata should not error")
+	_, r, err := stale.store.Read(s.ID, name)
+	assert.NoError(t, err, "Reading the old replica should not error")
+	old, err := io.ReadAll(r)
+	r.Close()
+	assert.NoError(t, err, "Reading the old replica should not error")
+
+	data := []byte("new version")
+	assert.NoError(t, s.Store("versioned", bytes.NewReader(data)), "Store should not error")
+	current, err := s.store.ReadMeta(s.ID, "versioned")
+	assert.NoError(t, err, "Reading the new metadata should not error")
+
+	// One owner goes back to the old version and another loses its copy
+	_, err = stale.store.Write(s.ID, name, bytes.NewReader(old))
+	assert.NoError(t, err, "Restoring the old replica should not error")
+	assert.NoError(t, stale.store.WriteMeta(s.ID, name, meta), "Restoring the old metadata should not error")
+	assert.NoError(t, servers[2].store.Delete(s.ID, name), "Deleting a replica should not error")
+
+	s.ReadConsistency = ConsistencyAll
+	assertFetch(t, s, "versioned", data)
+
+	waitForCluster(t, len(servers), func() bool {
+		for _, owner := range servers[1:] {
+			meta, err := owner.store.ReadMeta(s.ID, name)
+			if err != nil || meta.Provenance == nil || !bytes.Equal(meta.Provenance.Hash, current.Provenance.Hash) {
+				return false
+			}
+		}
+		return true
+	}, "stale replicas should be repaired")
+}
+
+func TestGetNeedsReadConsistency(t *testing.T) {
+	faults := p2p.NewFaultInjector(1)
+	servers := startCluster(t, 4, faults)
+	s := servers[0]
+
+	assert.NoError(t, s.Store("read", bytes.NewReader([]byte("needs every owner"))), "Store should not error")
+	assertReplicas(t, s, "read", true, servers[1:]...)
+	assert.NoError(t, s.store.Delete(s.ID, "read"), "Deleting local copy should not error")
+
+	faults.SetNodeFaults(servers[3].Transport.Addr(), p2p.Faults{Latency: 10 * time.Second})
+
+	s.ReadConsistency = ConsistencyAll
+	_, err := s.Get("read")
+	assert.ErrorIs(t, err, ErrReadConsistency, "Get should fail when an owner does not answer")
+
+	s.ReadConsistency = ConsistencyQuorum
+	_, err = s.Get("read")
+	assert.NoError(t, err, "Get should not error with a quorum")
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -18,12 +22,27 @@ func generateID() string {
 	return hex.EncodeToString(buf)
 }
 
-// hashKey creates a hash of the given key
+// hashKey creates an MD5 hash of the given key. It is unkeyed, so anyone
+// can confirm a guessed key name; it is only kept for existing stores.
 func hashKey(key string) string {
 	hash := md5.Sum([]byte(key))
 	return hex.EncodeToString(hash[:])
 }
 
+// hmacKey creates an HMAC-SHA256 of the given key under a cluster secret,
+// so peers holding replicas cannot guess or enumerate key names
+func hmacKey(secret []byte, key string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newKeyHashSecret derives the secret used to hash object keys from an
+// encryption key, so it never equals the key used for encryption
+func newKeyHashSecret(encKey []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, encKey, nil, "drift object key hash", 32)
+}
+
 // hashSHA1 creates a SHA1 hash of the given data
 func hashSHA1(data []byte) string {
 	hash := sha1.Sum(data)
@@ -80,19 +99,67 @@ func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	return copyStream(stream, block.BlockSize(), src, dst)
 }
 
-// copyEncrypt encrypts data from src and writes to dst
-func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+// newDecryptReader returns a reader that decrypts the stream written by
+// copyEncrypt as it is read from src
+func newDecryptReader(key []byte, src io.Reader) (io.Reader, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	// Generate a random IV
 	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(src, iv); err != nil {
+		return nil, err
+	}
+
+	return cipher.StreamReader{S: cipher.NewCTR(block, iv), R: src}, nil
+}
+
+// readCloser pairs a reader with the closer of the file underneath it
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// copyEncrypt encrypts data from src and writes to dst
+func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	// Generate a random IV
+	iv := make([]byte, aes.BlockSize)
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 		return 0, err
 	}
 
+	return copyEncryptIV(key, iv, src, dst)
+}
+
+// convergentIV derives the IV for convergent encryption from a keyed hash
+// of the content, so identical content always gets the same IV under a key
+func convergentIV(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("drift-convergent-iv"))
+	mac.Write(data)
+	return mac.Sum(nil)[:aes.BlockSize]
+}
+
+// copyEncryptConvergent encrypts data deterministically and writes to dst.
+// The output uses the same IV-prefixed format as copyEncrypt, so it is
+// decrypted with copyDecrypt. Anyone holding the key can tell whether two
+// objects, or an object and a guessed plaintext, are identical.
+func copyEncryptConvergent(key []byte, data []byte, dst io.Writer) (int, error) {
+	return copyEncryptIV(key, convergentIV(key, data), bytes.NewReader(data), dst)
+}
+
+// copyEncryptIV encrypts data from src with the given IV and writes the IV
+// followed by the ciphertext to dst
+func copyEncryptIV(key []byte, iv []byte, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(iv) != block.BlockSize() {
+		return 0, fmt.Errorf("invalid IV length: expected %d bytes, got %d", block.BlockSize(), len(iv))
+	}
+
 	// Write the IV to the destination
 	if _, err := dst.Write(iv); err != nil {
 		return 0, err
@@ -102,6 +169,46 @@ func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	return copyStream(stream, block.BlockSize(), src, dst)
 }
 
+// sealKey encrypts a data key under a key encryption key with AES-GCM
+func sealKey(kek []byte, dataKey []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+// openKey decrypts a data key sealed with sealKey
+func openKey(kek []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed key too short: %d bytes", len(sealed))
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
 // validateKey validates an encryption key
 func validateKey(key []byte) error {
 	if len(key) != 32 {
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -122,4 +123,86 @@ func TestHashSHA1(t *testing.T) {
 	differentData := []byte("different test data")
 	hash3 := hashSHA1(differentData)
 	assert.NotEqual(t, hash1, hash3, "Different data should produce different hashes")
-}
\ No newline at end of file
+}
+
+func TestCopyEncryptConvergent(t *testing.T) {
+	key := newEncryptionKey()
+	plaintext := []byte("This is a test message for convergent encryption")
+
+	var encrypted1, encrypted2 bytes.Buffer
+	_, err := copyEncryptConvergent(key, plaintext, &encrypted1)
+	assert.NoError(t, err, "Convergent encryption should not error")
+	_, err = copyEncryptConvergent(key, plaintext, &encrypted2)
+	assert.NoError(t, err, "Convergent encryption should not error")
+	assert.Equal(t, encrypted1.Bytes(), encrypted2.Bytes(), "Same content and key should encrypt identically")
+
+	// Decrypts with the regular stream format
+	var decrypted bytes.Buffer
+	_, err = copyDecrypt(key, bytes.NewReader(encrypted1.Bytes()), &decrypted)
+	assert.NoError(t, err, "Decryption should not error")
+	assert.Equal(t, plaintext, decrypted.Bytes(), "Decrypted data should match original")
+
+	// Other content or another key gives different ciphertext
+	var other bytes.Buffer
+	_, err = copyEncryptConvergent(key, []byte("This is another message"), &other)
+	assert.NoError(t, err, "Convergent encryption should not error")
+	assert.NotEqual(t, encrypted1.Bytes()[:16], other.Bytes()[:16], "Different content should use a different IV")
+
+	var otherKey bytes.Buffer
+	_, err = copyEncryptConvergent(newEncryptionKey(), plaintext, &otherKey)
+	assert.NoError(t, err, "Convergent encryption should not error")
+	assert.NotEqual(t, encrypted1.Bytes(), otherKey.Bytes(), "Different keys should give different ciphertext")
+}
+
+func TestHMACKey(t *testing.T) {
+	secret1, err := newKeyHashSecret(newEncryptionKey())
+	assert.NoError(t, err, "Deriving key hash secret should not error")
+	secret2, err := newKeyHashSecret(newEncryptionKey())
+	assert.NoError(t, err, "Deriving key hash secret should not error")
+
+	key := "payroll_2026.xlsx"
+	hash1 := hmacKey(secret1, key)
+
+	assert.Equal(t, hash1, hmacKey(secret1, key), "Keyed hash should be consistent")
+	assert.Equal(t, 64, len(hash1), "HMAC-SHA256 should be 64 characters")
+	assert.NotEqual(t, hash1, hmacKey(secret2, key), "Different secrets should produce different hashes")
+	assert.NotEqual(t, hashKey(key), hash1, "Keyed hash should differ from the legacy hash")
+}
+
+func TestNewDecryptReader(t *testing.T) {
+	key := newEncryptionKey()
+	plaintext := []byte("This is a test message for streaming decryption")
+
+	var encrypted bytes.Buffer
+	_, err := copyEncrypt(key, bytes.NewReader(plaintext), &encrypted)
+	assert.NoError(t, err, "Encryption should not error")
+
+	r, err := newDecryptReader(key, bytes.NewReader(encrypted.Bytes()))
+	assert.NoError(t, err, "Creating decrypt reader should not error")
+
+	decrypted, err := io.ReadAll(r)
+	assert.NoError(t, err, "Reading decrypted data should not error")
+	assert.Equal(t, plaintext, decrypted, "Decrypted data should match original")
+
+	_, err = newDecryptReader(key, bytes.NewReader([]byte("short")))
+	assert.Error(t, err, "Stream shorter than the IV should error")
+}
+
+func TestSealAndOpenKey(t *testing.T) {
+	kek := newEncryptionKey()
+	dataKey := newEncryptionKey()
+
+	sealed, err := sealKey(kek, dataKey)
+	assert.NoError(t, err, "Sealing should not error")
+	assert.NotContains(t, string(sealed), string(dataKey), "Sealed key should not contain the data key")
+
+	opened, err := openKey(kek, sealed)
+	assert.NoError(t, err, "Opening should not error")
+	assert.Equal(t, dataKey, opened, "Opened key should match the data key")
+
+	_, err = openKey(newEncryptionKey(), sealed)
+	assert.Error(t, err, "Opening with another key should fail")
+
+	_, err = openKey(kek, sealed[:4])
+	assert.Error(t, err, "Opening a truncated key should fail")
+}
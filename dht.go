@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// idBits is the size of node IDs and key IDs in the DHT
+	idBits = 256
+
+	defaultBucketSize   = 20
+	defaultAlpha        = 3
+	defaultQueryTimeout = 2 * time.Second
+)
+
+// kadID is a point in the DHT keyspace
+type kadID [idBits / 8]byte
+
+// nodeKadID returns the DHT position of a node. Node IDs are the hex
+// SHA-256 of the identity key; other IDs are hashed into the keyspace.
+func nodeKadID(id string) kadID {
+	var k kadID
+	if b, err := hex.DecodeString(id); err == nil && len(b) == len(k) {
+		copy(k[:], b)
+		return k
+	}
+	return sha256.Sum256([]byte(id))
+}
+
+// objectKadID returns the DHT position of an object, named by its owner
+// and the hashed key it is stored under
+func objectKadID(owner, name string) kadID {
+	return sha256.Sum256([]byte(owner + "/" + name))
+}
+
+// distance returns the XOR distance between two IDs
+func (k kadID) distance(o kadID) kadID {
+	var d kadID
+	for i := range k {
+		d[i] = k[i] ^ o[i]
+	}
+	return d
+}
+
+// bucket returns the index of the k-bucket o falls in as seen from k,
+// the length of their common prefix, or -1 when they are equal
+func (k kadID) bucket(o kadID) int {
+	d := k.distance(o)
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return -1
+}
+
+func (k kadID) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+// Contact is a node in the DHT and the address it can be dialed on
+type Contact struct {
+	ID   string
+	Addr string
+}
+
+// DHTOpts configures the Kademlia DHT
+type DHTOpts struct {
+	// BucketSize is k: the contacts kept per bucket, the contacts returned
+	// by a lookup and the nodes that keep a provider record
+	BucketSize int
+	// Alpha is how many nodes a lookup queries in parallel
+	Alpha int
+	// QueryTimeout bounds a single query, including dialing the node
+	QueryTimeout time.Duration
+}
+
+// DHT is a Kademlia routing table over node IDs, plus the provider
+// records this node keeps for the objects whose IDs are close to it.
+// A provider record says which node holds an object.
+type DHT struct {
+	DHTOpts
+
+	self kadID
+	// isAlive tells whether a contact may still be reachable; a full bucket
+	// only takes a new contact in place of one that is not
+	isAlive func(id string) bool
+
+	mu      sync.Mutex
+	buckets [idBits][]Contact
+	// providers are the holders of an object by object ID and node ID
+	providers map[kadID]map[string]Contact
+	seqNo     uint64
+	pending   map[uint64]pendingQuery
+}
+
+// pendingQuery is a query waiting for the response of the node asked
+type pendingQuery struct {
+	node     string
+	response chan MessageNodes
+}
+
+// NewDHT creates an empty DHT for the node with the given ID
+func NewDHT(id string, isAlive func(id string) bool, opts DHTOpts) *DHT {
+	if opts.BucketSize <= 0 {
+		opts.BucketSize = defaultBucketSize
+	}
+	if opts.Alpha <= 0 {
+		opts.Alpha = defaultAlpha
+	}
+	if opts.QueryTimeout <= 0 {
+		opts.QueryTimeout = defaultQueryTimeout
+	}
+
+	return &DHT{
+		DHTOpts:   opts,
+		self:      nodeKadID(id),
+		isAlive:   isAlive,
+		providers: make(map[kadID]map[string]Contact),
+		pending:   make(map[uint64]pendingQuery),
+	}
+}
+
+// Update records that a node was seen, moving it to the tail of its
+// bucket. When the bucket is full the least recently seen contact that is
+// no longer alive makes room; otherwise the new contact is dropped.
+func (d *DHT) Update(c Contact) {
+	i := d.self.bucket(nodeKadID(c.ID))
+	if i < 0 || len(c.Addr) == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bucket := d.buckets[i]
+	for j, known := range bucket {
+		if known.ID == c.ID {
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			d.buckets[i] = append(bucket, c)
+			return
+		}
+	}
+
+	if len(bucket) >= d.BucketSize {
+		evicted := false
+		for j, known := range bucket {
+			if !d.isAlive(known.ID) {
+				bucket = append(bucket[:j], bucket[j+1:]...)
+				evicted = true
+				break
+			}
+		}
+		if !evicted {
+			return
+		}
+	}
+
+	d.buckets[i] = append(bucket, c)
+}
+
+// Closest returns up to n known contacts closest to target
+func (d *DHT) Closest(target kadID, n int) []Contact {
+	d.mu.Lock()
+	contacts := []Contact{}
+	for _, bucket := range d.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	d.mu.Unlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// Size returns the number of contacts in the routing table
+func (d *DHT) Size() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := 0
+	for _, bucket := range d.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// AddProvider records that a node holds an object
+func (d *DHT) AddProvider(object kadID, c Contact) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.providers[object]; !ok {
+		d.providers[object] = make(map[string]Contact)
+	}
+	d.providers[object][c.ID] = c
+}
+
+// Providers returns the live nodes recorded to hold an object
+func (d *DHT) Providers(object kadID) []Contact {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	providers := []Contact{}
+	for _, c := range d.providers[object] {
+		if d.isAlive(c.ID) {
+			providers = append(providers, c)
+		}
+	}
+	return providers
+}
+
+// RemoveProviders drops every provider record of an object
+func (d *DHT) RemoveProviders(object kadID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.providers, object)
+}
+
+// expect returns a new query sequence number for a query sent to node and
+// the channel its response is delivered on
+func (d *DHT) expect(node string) (uint64, chan MessageNodes) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.seqNo++
+	ch := make(chan MessageNodes, 1)
+	d.pending[d.seqNo] = pendingQuery{node: node, response: ch}
+	return d.seqNo, ch
+}
+
+// respond delivers the response to a pending query, unless it comes from
+// another node than the one asked
+func (d *DHT) respond(from string, msg MessageNodes) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if query, ok := d.pending[msg.SeqNo]; ok && query.node == from {
+		query.response <- msg
+		delete(d.pending, msg.SeqNo)
+	}
+}
+
+// forget stops waiting for the response to a query
+func (d *DHT) forget(seqNo uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.pending, seqNo)
+}
+
+// sortByDistance sorts contacts by their distance to target, closest first
+func sortByDistance(contacts []Contact, target kadID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		di := nodeKadID(contacts[i].ID).distance(target)
+		dj := nodeKadID(contacts[j].ID).distance(target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKadIDBucket(t *testing.T) {
+	var a, b kadID
+	assert.Equal(t, -1, a.bucket(b), "Equal IDs should share no bucket")
+
+	b[0] = 0x80
+	assert.Equal(t, 0, a.bucket(b), "IDs differing in the first bit should be in bucket 0")
+
+	b[0], b[1] = 0, 0x01
+	assert.Equal(t, 15, a.bucket(b), "Bucket should be the common prefix length")
+}
+
+func TestDHTClosestAndEviction(t *testing.T) {
+	alive := map[string]bool{}
+	d := NewDHT(generateID(), func(id string) bool { return alive[id] }, DHTOpts{BucketSize: 2})
+
+	contacts := []Contact{}
+	for i := range 50 {
+		c := Contact{ID: generateID(), Addr: fmt.Sprintf("node%d", i)}
+		alive[c.ID] = true
+		contacts = append(contacts, c)
+		d.Update(c)
+	}
+
+	target := nodeKadID(generateID())
+	closest := d.Closest(target, 5)
+	assert.Len(t, closest, 5, "Closest should return the requested number of contacts")
+	for i := 1; i < len(closest); i++ {
+		prev := nodeKadID(closest[i-1].ID).distance(target)
+		next := nodeKadID(closest[i].ID).distance(target)
+		assert.True(t, bytes.Compare(prev[:], next[:]) < 0, "Contacts should be sorted by distance")
+	}
+
+	// About half of all IDs fall in bucket 0, which only keeps two
+	assert.Less(t, d.Size(), len(contacts), "Full buckets should drop new contacts")
+
+	self := d.self
+	var full []Contact
+	for _, c := range contacts {
+		if self.bucket(nodeKadID(c.ID)) == 0 {
+			full = append(full, c)
+		}
+	}
+	kept := d.Closest(nodeKadID(full[0].ID), 1)
+	alive[kept[0].ID] = false
+
+	for _, c := range full {
+		d.Update(c)
+	}
+	for _, c := range d.Closest(nodeKadID(full[0].ID), d.Size()) {
+		assert.NotEqual(t, kept[0].ID, c.ID, "Dead contact should be evicted from a full bucket")
+	}
+}
+
+func TestDHTRespondBindsQueriedNode(t *testing.T) {
+	d := NewDHT(generateID(), func(string) bool { return true }, DHTOpts{})
+	asked, spy := generateID(), generateID()
+
+	seqNo, response := d.expect(asked)
+	forged := Contact{ID: spy, Addr: "spy"}
+	d.respond(spy, MessageNodes{SeqNo: seqNo, Providers: []Contact{forged}})
+	assert.Empty(t, response, "Response from another node should be dropped")
+
+	d.respond(asked, MessageNodes{SeqNo: seqNo})
+	if assert.Len(t, response, 1, "Response from the queried node should be delivered") {
+		assert.Empty(t, (<-response).Providers, "Forged providers should not be delivered")
+	}
+}
+
+func TestDHTLocatesFarProviders(t *testing.T) {
+	network := p2p.NewMemoryNetwork()
+	servers := make([]*FileServer, 16)
+
+	// A line: every node is only connected to the one before it
+	for i := range servers {
+		addr := fmt.Sprintf("node%d", i)
+		nodes := []string{}
+		if i > 0 {
+			nodes = append(nodes, fmt.Sprintf("node%d", i-1))
+		}
+		servers[i] = newMemoryServer(t, network, nil, addr, nodes...)
+		servers[i].PeerDegree = -1
+		// Most members cannot be probed from a line; keep them all on the ring
+		servers[i].members.SuspicionTimeout = time.Minute
+		assert.NoError(t, servers[i].Transport.ListenAndAccept(), "Listening should not error")
+	}
+	for _, s := range servers {
+		s.bootstrapNetwork()
+		go s.loop()
+	}
+	waitForCluster(t, len(servers), func() bool {
+		for i, s := range servers {
+			if i > 0 && len(s.peerList()) == 0 {
+				return false
+			}
+		}
+		return true
+	}, "line should be connected")
+
+	// Membership only spreads along the line by gossip; give every node the
+	// full view so they all place replicas on the same ring
+	for _, s := range servers {
+		for _, o := range servers {
+			s.applyGossip(o.members.Snapshot()[:1])
+		}
+	}
+	// Let rebalancing settle on that ring before anything is stored
+	time.Sleep(2 * servers[0].members.ProbeInterval)
+
+	first, last := servers[0], servers[len(servers)-1]
+	data := []byte("found through the DHT")
+	// A replica written after Store returns would be announced after the
+	// delete removes the records
+	last.WriteConsistency = ConsistencyAll
+	assert.NoError(t, last.Store("far", bytes.NewReader(data)), "Store should not error")
+
+	// The first node only reaches the holders at the other end through lookups
+	name := last.hashObjectKey("far")
+	var providers []Contact
+	waitForCluster(t, len(servers), func() bool {
+		providers = first.findProviders(context.Background(), last.ID, name)
+		return len(providers) > 0
+	}, "lookup should find the holders of the file")
+	for _, p := range providers {
+		assert.NotEqual(t, first.nodeID(), p.ID, "Node should not find itself")
+	}
+
+	assertFetch(t, last, "far", data)
+
+	assert.NoError(t, last.Delete("far"), "Delete should not error")
+	waitForCluster(t, len(servers), func() bool {
+		return len(first.findProviders(context.Background(), last.ID, name)) == 0
+	}, "provider records should be removed on delete")
+}
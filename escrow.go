@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sharePrefix marks an escrow share of a cluster key
+const sharePrefix = "drift-share-v1"
+
+// newShareSet returns a random ID for the shares of one split, so shares
+// of different splits are not combined. It is not derived from the key:
+// a hash of it in every share would let a share holder check guessed
+// passphrases offline.
+func newShareSet() (string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// splitKey splits a key into n printable escrow shares, any threshold of
+// which recover it with recoverKey
+func splitKey(key []byte, n, threshold int) ([]string, error) {
+	parts, err := splitSecret(key, n, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	set, err := newShareSet()
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([]string, len(parts))
+	for i, part := range parts {
+		shares[i] = fmt.Sprintf("%s:%d:%s:%s", sharePrefix, threshold, set, hex.EncodeToString(part))
+	}
+
+	return shares, nil
+}
+
+// recoverKey reconstructs a key from escrow shares made by splitKey
+func recoverKey(shares []string) ([]byte, error) {
+	var (
+		parts     [][]byte
+		threshold int
+		set       string
+	)
+
+	for _, share := range shares {
+		fields := strings.Split(strings.TrimSpace(share), ":")
+		if len(fields) != 4 || fields[0] != sharePrefix {
+			return nil, errors.New("malformed key share")
+		}
+
+		k, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed key share threshold: %w", err)
+		}
+		if len(set) > 0 && (k != threshold || fields[2] != set) {
+			return nil, errors.New("key shares belong to different splits")
+		}
+		threshold, set = k, fields[2]
+
+		part, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed key share: %w", err)
+		}
+		parts = append(parts, part)
+	}
+
+	if len(parts) < threshold {
+		return nil, fmt.Errorf("need %d key shares, got %d", threshold, len(parts))
+	}
+
+	key, err := combineShares(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, validateKey(key)
+}
+
+// runKeyCommand runs the "key" subcommands that escrow a cluster key:
+//
+//	drift key split -root <StorageRoot> -n 5 -k 3 [-out <dir>]
+//	drift key recover -root <StorageRoot> <share> <share> <share>
+func runKeyCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: drift key split|recover [flags]")
+	}
+
+	switch args[0] {
+	case "split":
+		return runKeySplit(args[1:])
+	case "recover":
+		return runKeyRecover(args[1:])
+	}
+
+	return fmt.Errorf("unknown key command: %s", args[0])
+}
+
+// runKeySplit splits the node's cluster key into escrow shares. The
+// shares are printed, or written one file each to a directory the
+// operator picks outside the storage root, never next to the key.
+func runKeySplit(args []string) error {
+	fs := flag.NewFlagSet("key split", flag.ContinueOnError)
+	root := fs.String("root", defaultRootFolderName, "storage root holding the keyring")
+	n := fs.Int("n", 5, "number of shares to create")
+	threshold := fs.Int("k", 3, "number of shares needed to recover the key")
+	out := fs.String("out", "", "directory to write share files to, outside the storage root; shares are printed when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(*out) > 0 {
+		inside, err := withinDir(*root, *out)
+		if err != nil {
+			return err
+		}
+		if inside {
+			return fmt.Errorf("shares must not be written inside the storage root %s", *root)
+		}
+	}
+
+	keyring := NewKeyring(*root)
+
+	var (
+		key []byte
+		err error
+	)
+	if passphrase := os.Getenv("DRIFT_PASSPHRASE"); len(passphrase) > 0 {
+		key, err = keyring.DeriveClusterKey(clusterName(), passphrase)
+	} else {
+		key, err = keyring.ClusterKey(keyringPassphrase())
+	}
+	if err != nil {
+		return fmt.Errorf("loading cluster key: %w", err)
+	}
+
+	shares, err := splitKey(key, *n, *threshold)
+	if err != nil {
+		return err
+	}
+
+	if len(*out) == 0 {
+		for _, share := range shares {
+			fmt.Printf("%s\n", share)
+		}
+	} else {
+		if err := os.MkdirAll(*out, 0700); err != nil {
+			return err
+		}
+
+		for i, share := range shares {
+			path := filepath.Join(*out, fmt.Sprintf("share-%d.txt", i+1))
+			if err := os.WriteFile(path, []byte(share+"\n"), 0600); err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", path)
+		}
+	}
+
+	fmt.Printf("split cluster key into %d shares, %d needed to recover\n", *n, *threshold)
+
+	return nil
+}
+
+// withinDir reports whether path is dir or inside it
+func withinDir(dir string, path string) (bool, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false, err
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// runKeyRecover reconstructs the cluster key from escrow shares, given
+// inline or as share files, and stores it in the keyring sealed with
+// DRIFT_KEYRING_PASSPHRASE
+func runKeyRecover(args []string) error {
+	fs := flag.NewFlagSet("key recover", flag.ContinueOnError)
+	root := fs.String("root", defaultRootFolderName, "storage root holding the keyring")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	secret := keyringPassphrase()
+	if len(secret) == 0 {
+		return errors.New("DRIFT_KEYRING_PASSPHRASE must be set to store the recovered key")
+	}
+
+	var shares []string
+	for _, arg := range fs.Args() {
+		if strings.HasPrefix(arg, sharePrefix) {
+			shares = append(shares, arg)
+			continue
+		}
+
+		b, err := os.ReadFile(arg)
+		if err != nil {
+			return err
+		}
+		shares = append(shares, string(bytes.TrimSpace(b)))
+	}
+
+	key, err := recoverKey(shares)
+	if err != nil {
+		return err
+	}
+
+	if err := NewKeyring(*root).SetClusterKey(key, secret); err != nil {
+		return err
+	}
+
+	fmt.Printf("recovered cluster key into %s\n", *root)
+
+	return nil
+}
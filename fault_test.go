@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertReplicas waits until the given servers hold, or no longer hold,
+// the replica of a key stored by owner
+func assertReplicas(t *testing.T, owner *FileServer, key string, want bool, servers ...*FileServer) {
+	t.Helper()
+
+	name := owner.hashObjectKey(key)
+	waitForCluster(t, len(owner.members.Members()), func() bool {
+		for _, s := range servers {
+			if s.store.Has(owner.ID, name) != want {
+				return false
+			}
+		}
+		return true
+	}, fmt.Sprintf("replicas of %s should be present: %v", key, want))
+}
+
+// assertFetch drops the local copy of a key and checks Get fetches the
+// same data back from the network
+func assertFetch(t *testing.T, s *FileServer, key string, data []byte) {
+	t.Helper()
+
+	assert.NoError(t, s.store.Delete(s.ID, key), "Deleting local copy should not error")
+
+	r, err := s.Get(key)
+	if !assert.NoError(t, err, "Get should fetch the file from the network") {
+		return
+	}
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err, "Reading the file should not error")
+	r.(io.Closer).Close()
+	assert.Equal(t, data, b, "Fetched file should match what was stored")
+}
+
+func TestFaultsSlowLinks(t *testing.T) {
+	faults := p2p.NewFaultInjector(1)
+	servers := startCluster(t, 4, faults)
+	faults.SetFaults(p2p.Faults{Latency: 5 * time.Millisecond, Bandwidth: 1024 * 1024})
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+
+	s := servers[0]
+	assert.NoError(t, s.Store("slow", bytes.NewReader(data)), "Store should not error over slow links")
+	assertReplicas(t, s, "slow", true, servers[1:]...)
+
+	assertFetch(t, s, "slow", data)
+
+	assert.NoError(t, s.Delete("slow"), "Delete should not error over slow links")
+	assertReplicas(t, s, "slow", false, servers[1:]...)
+}
+
+func TestFaultsCorruptPeer(t *testing.T) {
+	faults := p2p.NewFaultInjector(1)
+	servers := startCluster(t, 3, faults)
+	s := servers[0]
+	data := []byte("survives a corrupting peer")
+
+	assert.NoError(t, s.Store("corrupt", bytes.NewReader(data)), "Store should not error")
+	assertReplicas(t, s, "corrupt", true, servers[1:]...)
+
+	// Everything node1 sends is corrupted, so its answer is dropped and
+	// the file has to come from node2, the only other owner
+	faults.SetNodeFaults("node1", p2p.Faults{CorruptRate: 1})
+	s.ReadConsistency = ConsistencyOne
+	assertFetch(t, s, "corrupt", data)
+}
+
+func TestFaultsRandomDisconnects(t *testing.T) {
+	faults := p2p.NewFaultInjector(1)
+	servers := startCluster(t, 4, faults)
+	s := servers[0]
+
+	faults.SetNodeFaults("node3", p2p.Faults{DisconnectRate: 0.5})
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		data := []byte(fmt.Sprintf("content of file %d", i))
+
+		assert.NoError(t, s.Store(key, bytes.NewReader(data)), "Store should not error while a peer drops out")
+		assertReplicas(t, s, key, true, servers[1], servers[2])
+		// While cut off, node3 declares the others dead and gossips it
+		// when it reconnects; wait for them to refute it so the read
+		// asks both healthy owners
+		waitForCluster(t, len(servers), func() bool {
+			nodes := s.currentRing().Nodes()
+			return slices.Contains(nodes, servers[1].nodeID()) && slices.Contains(nodes, servers[2].nodeID())
+		}, "healthy owners should be on the ring")
+		assertFetch(t, s, key, data)
+	}
+
+	assert.NoError(t, s.Delete("file_0"), "Delete should not error while a peer drops out")
+	assertReplicas(t, s, "file_0", false, servers[1], servers[2])
+}
+
+func TestFaultsPartition(t *testing.T) {
+	faults := p2p.NewFaultInjector(1)
+	servers := startCluster(t, 4, faults)
+	isolated, s := servers[0], servers[1]
+
+	data := []byte("stored before the partition")
+	assert.NoError(t, isolated.Store("before", bytes.NewReader(data)), "Store should not error")
+	assertReplicas(t, isolated, "before", true, servers[1:]...)
+
+	// The isolated node keeps suspecting the majority rather than
+	// declaring it dead, so its own ring still places replicas there
+	isolated.members.mu.Lock()
+	isolated.members.SuspicionTimeout = time.Minute
+	isolated.members.mu.Unlock()
+
+	faults.Partition("minority", "node0")
+
+	// Both sides notice the dropped connections and forget each other
+	waitForCluster(t, len(servers), func() bool {
+		return len(isolated.peerList()) == 0 && len(s.peerList()) == 2
+	}, "peers across the partition should be removed")
+
+	// Once the majority declared the isolated node dead it drops out of
+	// their rings
+	waitForCluster(t, len(servers), func() bool {
+		for _, o := range servers[1:] {
+			if slices.Contains(o.currentRing().Nodes(), isolated.nodeID()) {
+				return false
+			}
+		}
+		return true
+	}, "isolated node should leave the majority's rings")
+
+	// The majority side keeps replicating among itself. Waiting for every
+	// owner means no replica is still in flight when Store returns.
+	s.WriteConsistency = ConsistencyAll
+	assert.NoError(t, s.Store("during", bytes.NewReader([]byte("majority"))), "Store should not error in the majority")
+	assert.ElementsMatch(t, servers[2:], ringOwners(s, "during", servers), "Only the majority should own replicas")
+	assertReplicas(t, s, "during", true, servers[2:]...)
+	assert.False(t, isolated.store.Has(s.ID, s.hashObjectKey("during")), "Isolated node should not get replicas")
+
+	// The isolated node still stores locally but reaches no quorum, and
+	// cannot fetch
+	err := isolated.Store("alone", bytes.NewReader([]byte("local")))
+	assert.ErrorIs(t, err, ErrWriteConsistency, "Store should not reach a quorum when isolated")
+	assert.True(t, isolated.store.Has(isolated.ID, "alone"), "Store should keep the local copy when isolated")
+	assert.NoError(t, isolated.store.Delete(isolated.ID, "before"), "Deleting local copy should not error")
+	_, err = isolated.Get("before")
+	assert.Error(t, err, "Get should fail when every replica is across the partition")
+
+	assert.NoError(t, s.Delete("during"), "Delete should not error in the majority")
+	assertReplicas(t, s, "during", false, servers[2:]...)
+}
@@ -4,6 +4,7 @@ go 1.24.0
 
 require (
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/crypto v0.43.0
 )
 
 require (
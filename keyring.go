@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keyringFolderName = "keyring"
+	kdfAlgorithm      = "scrypt"
+	// defaultClusterName names the cluster when DRIFT_CLUSTER is not set
+	defaultClusterName = "drift"
+)
+
+// KDFParams records how a key was derived from a passphrase so that
+// the same key can be reproduced on restart
+type KDFParams struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	N         int    `json:"n"`
+	R         int    `json:"r"`
+	P         int    `json:"p"`
+	KeyLen    int    `json:"key_len"`
+	// Cluster names the cluster whose shared key the parameters derive
+	Cluster string `json:"cluster,omitempty"`
+}
+
+// newKDFParams returns scrypt parameters with a fresh random salt
+func newKDFParams() (KDFParams, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return KDFParams{}, err
+	}
+
+	return scryptParams(salt), nil
+}
+
+// clusterKDFParams returns the default scrypt parameters of a cluster's
+// key. The salt is taken from the cluster name instead of a node's
+// keyring, so every node given the cluster's passphrase derives the same
+// key without sharing a file.
+func clusterKDFParams(cluster string) KDFParams {
+	salt := sha256.Sum256([]byte("drift-cluster-key-v1:" + cluster))
+	params := scryptParams(salt[:16])
+	params.Cluster = cluster
+	return params
+}
+
+// scryptParams returns the scrypt cost parameters used for every key
+func scryptParams(salt []byte) KDFParams {
+	return KDFParams{
+		Algorithm: kdfAlgorithm,
+		Salt:      salt,
+		N:         1 << 15,
+		R:         8,
+		P:         1,
+		KeyLen:    32,
+	}
+}
+
+// deriveKey derives an encryption key from a passphrase
+func deriveKey(passphrase string, params KDFParams) ([]byte, error) {
+	if params.Algorithm != kdfAlgorithm {
+		return nil, fmt.Errorf("unsupported key derivation algorithm: %s", params.Algorithm)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), params.Salt, params.N, params.R, params.P, params.KeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, validateKey(key)
+}
+
+// Keyring manages key material persisted under a node's storage root
+type Keyring struct {
+	root string
+}
+
+// NewKeyring creates a keyring rooted in the given storage root
+func NewKeyring(storageRoot string) *Keyring {
+	if len(storageRoot) == 0 {
+		storageRoot = defaultRootFolderName
+	}
+
+	return &Keyring{
+		root: filepath.Join(storageRoot, keyringFolderName),
+	}
+}
+
+// path returns the location of a named keyring entry
+func (k *Keyring) path(name string) string {
+	return filepath.Join(k.root, name)
+}
+
+// readJSON loads a keyring entry into v
+func (k *Keyring) readJSON(name string, v any) error {
+	b, err := os.ReadFile(k.path(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSON persists v as a keyring entry readable only by the owner
+func (k *Keyring) writeJSON(name string, v any) error {
+	if err := os.MkdirAll(k.root, 0700); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(k.path(name), b, 0600)
+}
+
+// KDFParams returns the derivation parameters stored for the named key,
+// creating and persisting fresh ones on first use
+func (k *Keyring) KDFParams(name string) (KDFParams, error) {
+	var params KDFParams
+
+	err := k.readJSON(name+".kdf.json", &params)
+	if err == nil {
+		return params, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return params, err
+	}
+
+	params, err = newKDFParams()
+	if err != nil {
+		return params, err
+	}
+
+	return params, k.writeJSON(name+".kdf.json", params)
+}
+
+// DeriveKey derives the named key from a passphrase using the parameters
+// recorded in the keyring. The salt is random per keyring, so the key is
+// this node's own; a key shared by the cluster comes from
+// DeriveClusterKey.
+func (k *Keyring) DeriveKey(name string, passphrase string) ([]byte, error) {
+	params, err := k.KDFParams(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return deriveKey(passphrase, params)
+}
+
+// ClusterKDFParams returns the derivation parameters of the named
+// cluster's key stored in the keyring, recording the defaults on first
+// use. Replacing the stored parameters on every node, with a random salt
+// or a higher cost, changes the cluster key without changing the code.
+func (k *Keyring) ClusterKDFParams(cluster string) (KDFParams, error) {
+	if len(cluster) == 0 {
+		return KDFParams{}, errors.New("empty cluster name")
+	}
+
+	var params KDFParams
+
+	err := k.readJSON("cluster.kdf.json", &params)
+	if err == nil {
+		if params.Cluster != cluster {
+			return params, fmt.Errorf("keyring holds the key parameters of cluster %q, not %q", params.Cluster, cluster)
+		}
+		return params, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return params, err
+	}
+
+	params = clusterKDFParams(cluster)
+	return params, k.writeJSON("cluster.kdf.json", params)
+}
+
+// DeriveClusterKey derives the key shared by the nodes of the named
+// cluster from its passphrase, using the parameters stored in the keyring
+func (k *Keyring) DeriveClusterKey(cluster string, passphrase string) ([]byte, error) {
+	params, err := k.ClusterKDFParams(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return deriveKey(passphrase, params)
+}
+
+// identityEntry is the on-disk form of a node's identity key
+type identityEntry struct {
+	Seed []byte `json:"seed"`
+}
+
+// IdentityKey returns the node's Ed25519 identity key, generating and
+// persisting one on first use
+func (k *Keyring) IdentityKey() (ed25519.PrivateKey, error) {
+	var entry identityEntry
+
+	err := k.readJSON("identity.json", &entry)
+	if err == nil {
+		if len(entry.Seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid identity key length: %d", len(entry.Seed))
+		}
+		return ed25519.NewKeyFromSeed(entry.Seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Seed = priv.Seed()
+	return priv, k.writeJSON("identity.json", entry)
+}
+
+// exchangeEntry is the on-disk form of a node's X25519 exchange key
+type exchangeEntry struct {
+	PrivateKey []byte `json:"private_key"`
+}
+
+// ExchangeKey returns the node's X25519 key used to receive shared files,
+// generating and persisting one on first use
+func (k *Keyring) ExchangeKey() (*ecdh.PrivateKey, error) {
+	var entry exchangeEntry
+
+	err := k.readJSON("exchange.json", &entry)
+	if err == nil {
+		return ecdh.X25519().NewPrivateKey(entry.PrivateKey)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.PrivateKey = priv.Bytes()
+	return priv, k.writeJSON("exchange.json", entry)
+}
+
+// clusterKeyEntry is the on-disk form of a cluster key generated by a
+// node or recovered from escrow shares. The key is sealed with one derived
+// from a passphrase that is never written to disk.
+type clusterKeyEntry struct {
+	Sealed []byte `json:"sealed"`
+}
+
+// ClusterKey returns the cluster key stored in the keyring, unsealed with
+// the passphrase it was stored with. The error wraps os.ErrNotExist when
+// none has been stored.
+func (k *Keyring) ClusterKey(passphrase string) ([]byte, error) {
+	var entry clusterKeyEntry
+	if err := k.readJSON("cluster.key.json", &entry); err != nil {
+		return nil, err
+	}
+
+	kek, err := k.DeriveKey("cluster.key", passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := openKey(kek, entry.Sealed)
+	if err != nil {
+		return nil, fmt.Errorf("unsealing cluster key: %w", err)
+	}
+
+	return key, validateKey(key)
+}
+
+// SetClusterKey stores the cluster key in the keyring, sealed with a key
+// derived from passphrase
+func (k *Keyring) SetClusterKey(key []byte, passphrase string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	kek, err := k.DeriveKey("cluster.key", passphrase)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := sealKey(kek, key)
+	if err != nil {
+		return err
+	}
+
+	return k.writeJSON("cluster.key.json", clusterKeyEntry{Sealed: sealed})
+}
+
+// dataKeyEntry is the on-disk form of a sealed per-object data key
+type dataKeyEntry struct {
+	Sealed []byte `json:"sealed"`
+}
+
+// dataKeyName returns the keyring entry holding an object's data key
+func dataKeyName(name string) string {
+	return filepath.Join("objects", name+".json")
+}
+
+// WriteDataKey stores the sealed data key of the named object
+func (k *Keyring) WriteDataKey(name string, sealed []byte) error {
+	if err := os.MkdirAll(k.path("objects"), 0700); err != nil {
+		return err
+	}
+
+	return k.writeJSON(dataKeyName(name), dataKeyEntry{Sealed: sealed})
+}
+
+// DataKey returns the sealed data key of the named object
+func (k *Keyring) DataKey(name string) ([]byte, error) {
+	var entry dataKeyEntry
+	if err := k.readJSON(dataKeyName(name), &entry); err != nil {
+		return nil, err
+	}
+
+	return entry.Sealed, nil
+}
+
+// DeleteDataKey destroys the data key of the named object, overwriting
+// it before unlinking so the object can no longer be decrypted
+func (k *Keyring) DeleteDataKey(name string) error {
+	path := k.path(dataKeyName(name))
+	if err := overwriteFile(path); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyringDeriveKey(t *testing.T) {
+	root := "test_keyring"
+	defer os.RemoveAll(root)
+
+	key1, err := NewKeyring(root).DeriveKey("node", "correct horse battery staple")
+	assert.NoError(t, err, "Deriving a key should not error")
+	assert.NoError(t, validateKey(key1), "Derived key should be a valid encryption key")
+
+	// A fresh keyring over the same root reproduces the key
+	key2, err := NewKeyring(root).DeriveKey("node", "correct horse battery staple")
+	assert.NoError(t, err, "Deriving a key again should not error")
+	assert.Equal(t, key1, key2, "Same passphrase and stored parameters should give the same key")
+
+	key3, err := NewKeyring(root).DeriveKey("node", "wrong passphrase")
+	assert.NoError(t, err, "Deriving with another passphrase should not error")
+	assert.NotEqual(t, key1, key3, "Different passphrases should give different keys")
+
+	key4, err := NewKeyring(root).DeriveKey("backup", "correct horse battery staple")
+	assert.NoError(t, err, "Deriving another named key should not error")
+	assert.NotEqual(t, key1, key4, "Different names use different salts")
+}
+
+func TestDeriveClusterKey(t *testing.T) {
+	roots := []string{"test_keyring_cluster_a", "test_keyring_cluster_b", "test_keyring_cluster_c"}
+	for _, root := range roots {
+		defer os.RemoveAll(root)
+	}
+
+	key1, err := NewKeyring(roots[0]).DeriveClusterKey("drift", "correct horse battery staple")
+	assert.NoError(t, err, "Deriving a cluster key should not error")
+	assert.NoError(t, validateKey(key1), "Derived cluster key should be a valid encryption key")
+
+	// Another node derives the same key without any shared file
+	key2, err := NewKeyring(roots[1]).DeriveClusterKey("drift", "correct horse battery staple")
+	assert.NoError(t, err, "Deriving a cluster key again should not error")
+	assert.Equal(t, key1, key2, "Nodes of a cluster should derive the same key")
+
+	key3, err := NewKeyring(roots[2]).DeriveClusterKey("other", "correct horse battery staple")
+	assert.NoError(t, err, "Deriving another cluster's key should not error")
+	assert.NotEqual(t, key1, key3, "Different clusters should get different keys")
+
+	_, err = NewKeyring(roots[0]).DeriveClusterKey("", "correct horse battery staple")
+	assert.Error(t, err, "Empty cluster name should be rejected")
+
+	_, err = NewKeyring(roots[0]).DeriveClusterKey("other", "correct horse battery staple")
+	assert.Error(t, err, "Keyring of one cluster should not derive another cluster's key")
+}
+
+func TestClusterKDFParamsAreStored(t *testing.T) {
+	root := "test_keyring_cluster_params"
+	defer os.RemoveAll(root)
+
+	keyring := NewKeyring(root)
+	params, err := keyring.ClusterKDFParams("drift")
+	assert.NoError(t, err, "Reading the cluster parameters should not error")
+	assert.Equal(t, clusterKDFParams("drift"), params, "Defaults should be used on first start")
+	assert.FileExists(t, keyring.path("cluster.kdf.json"), "Parameters should be stored in the keyring")
+
+	key1, err := keyring.DeriveClusterKey("drift", "correct horse battery staple")
+	assert.NoError(t, err, "Deriving a cluster key should not error")
+
+	// An operator replaces the salt and raises the cost
+	params, err = newKDFParams()
+	assert.NoError(t, err, "Generating parameters should not error")
+	params.N = 1 << 16
+	params.Cluster = "drift"
+	assert.NoError(t, keyring.writeJSON("cluster.kdf.json", params), "Storing parameters should not error")
+
+	stored, err := NewKeyring(root).ClusterKDFParams("drift")
+	assert.NoError(t, err, "Reading the stored parameters should not error")
+	assert.Equal(t, params, stored, "Stored parameters should be read back")
+
+	key2, err := NewKeyring(root).DeriveClusterKey("drift", "correct horse battery staple")
+	assert.NoError(t, err, "Deriving with the stored parameters should not error")
+	assert.NotEqual(t, key1, key2, "Stored parameters should be used to derive the key")
+}
+
+func TestDeriveKeyInvalidParams(t *testing.T) {
+	params, err := newKDFParams()
+	assert.NoError(t, err, "Generating parameters should not error")
+
+	_, err = deriveKey("", params)
+	assert.Error(t, err, "Empty passphrase should be rejected")
+
+	params.Algorithm = "md5"
+	_, err = deriveKey("passphrase", params)
+	assert.Error(t, err, "Unknown algorithm should be rejected")
+}
+
+func TestKeyringDataKey(t *testing.T) {
+	root := "test_keyring_data"
+	defer os.RemoveAll(root)
+
+	keyring := NewKeyring(root)
+	sealed := []byte("sealed data key")
+
+	assert.NoError(t, keyring.WriteDataKey("object", sealed), "Writing data key should not error")
+
+	got, err := keyring.DataKey("object")
+	assert.NoError(t, err, "Reading data key should not error")
+	assert.Equal(t, sealed, got, "Data key should round trip")
+
+	assert.NoError(t, keyring.DeleteDataKey("object"), "Deleting data key should not error")
+	_, err = keyring.DataKey("object")
+	assert.ErrorIs(t, err, os.ErrNotExist, "Data key should be gone after deletion")
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+)
+
+// errServerStopped is returned by operations cut short by Stop
+var errServerStopped = errors.New("file server stopped")
+
+// MessageFindNode asks a node for the contacts it knows closest to Target
+type MessageFindNode struct {
+	SeqNo  uint64
+	Target kadID
+}
+
+// MessageFindValue asks a node for the providers of an object, and for
+// closer contacts when it knows none
+type MessageFindValue struct {
+	SeqNo  uint64
+	Target kadID
+	Owner  string
+	Key    string
+}
+
+// MessageNodes answers MessageFindNode and MessageFindValue
+type MessageNodes struct {
+	SeqNo     uint64
+	Contacts  []Contact
+	Providers []Contact
+}
+
+// MessageAddProvider asks a node close to an object to remember which
+// nodes hold it
+type MessageAddProvider struct {
+	Object    kadID
+	Providers []Contact
+}
+
+// lookupResult is the answer of one node during a lookup
+type lookupResult struct {
+	contact Contact
+	msg     MessageNodes
+	err     error
+}
+
+// lookup runs an iterative Kademlia lookup: it queries the Alpha closest
+// contacts to target it has not asked yet, merges the closer contacts
+// they return, and stops once the BucketSize closest have all answered.
+// With find set it asks for the providers of an object instead and stops
+// after the first round that finds some. It returns the closest contacts
+// that did not fail and the providers found, as far as it got before ctx
+// was done.
+func (s *FileServer) lookup(ctx context.Context, target kadID, find *MessageFindValue) ([]Contact, []Contact) {
+	self := s.nodeID()
+	seen := map[string]bool{self: true}
+	queried := map[string]bool{}
+	failed := map[string]bool{}
+
+	shortlist := s.dht.Closest(target, s.dht.BucketSize)
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+
+	found := map[string]Contact{}
+	if find != nil {
+		for _, c := range s.dht.Providers(target) {
+			found[c.ID] = c
+		}
+	}
+
+	for len(found) == 0 && ctx.Err() == nil {
+		batch := []Contact{}
+		for _, c := range shortlist {
+			if len(batch) == s.dht.Alpha {
+				break
+			}
+			if !queried[c.ID] {
+				queried[c.ID] = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan lookupResult, len(batch))
+		var wg sync.WaitGroup
+		for _, c := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				msg, err := s.query(ctx, c, target, find)
+				results <- lookupResult{contact: c, msg: msg, err: err}
+			}()
+		}
+		wg.Wait()
+		close(results)
+
+		for res := range results {
+			if res.err != nil {
+				log.Printf("[%s] querying (%s) for %s: %v", s.Transport.Addr(), res.contact.ID, target, res.err)
+				failed[res.contact.ID] = true
+				continue
+			}
+			for _, c := range res.msg.Providers {
+				if c.ID != self {
+					found[c.ID] = c
+				}
+			}
+			for _, c := range res.msg.Contacts {
+				if !seen[c.ID] {
+					seen[c.ID] = true
+					shortlist = append(shortlist, c)
+				}
+			}
+		}
+
+		live := shortlist[:0]
+		for _, c := range shortlist {
+			if !failed[c.ID] {
+				live = append(live, c)
+			}
+		}
+		shortlist = live
+		sortByDistance(shortlist, target)
+		if len(shortlist) > s.dht.BucketSize {
+			shortlist = shortlist[:s.dht.BucketSize]
+		}
+	}
+
+	providers := make([]Contact, 0, len(found))
+	for _, c := range found {
+		providers = append(providers, c)
+	}
+
+	return shortlist, providers
+}
+
+// query sends a single lookup request to a contact and waits for the answer
+func (s *FileServer) query(ctx context.Context, c Contact, target kadID, find *MessageFindValue) (MessageNodes, error) {
+	peer, err := s.connect(ctx, c)
+	if err != nil {
+		return MessageNodes{}, err
+	}
+
+	seqNo, response := s.dht.expect(c.ID)
+	defer s.dht.forget(seqNo)
+
+	msg := Message{
+		Payload: MessageFindNode{SeqNo: seqNo, Target: target},
+	}
+	if find != nil {
+		req := *find
+		req.SeqNo = seqNo
+		req.Target = target
+		msg.Payload = req
+	}
+	if err := s.send(peer, &msg); err != nil {
+		return MessageNodes{}, err
+	}
+
+	timer := time.NewTimer(s.dht.QueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-response:
+		// A node only knows the address it listens on from its own side
+		for i, p := range resp.Providers {
+			if p.ID == c.ID {
+				resp.Providers[i].Addr = c.Addr
+			}
+		}
+		return resp, nil
+	case <-timer.C:
+		return MessageNodes{}, fmt.Errorf("no answer within %s", s.dht.QueryTimeout)
+	case <-ctx.Done():
+		return MessageNodes{}, ctx.Err()
+	case <-s.quitch:
+		return MessageNodes{}, errServerStopped
+	}
+}
+
+// connect returns the connection to a contact, dialing it if there is none
+func (s *FileServer) connect(ctx context.Context, c Contact) (p2p.Peer, error) {
+	if peer, ok := s.peer(c.ID); ok {
+		return peer, nil
+	}
+	if err := s.Transport.Dial(c.Addr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.dht.QueryTimeout)
+	defer timer.Stop()
+
+	for {
+		s.peerLock.Lock()
+		peer, ok := s.peers[c.ID]
+		changed := s.peersChanged
+		s.peerLock.Unlock()
+		if ok {
+			return peer, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, fmt.Errorf("connecting to %s timed out", c.Addr)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.quitch:
+			return nil, errServerStopped
+		}
+	}
+}
+
+// self returns this node's contact
+func (s *FileServer) self() Contact {
+	return Contact{ID: s.nodeID(), Addr: s.Transport.Addr()}
+}
+
+// announce records holders as providers of an object, locally and on the
+// nodes closest to the object
+func (s *FileServer) announce(ctx context.Context, owner, name string, holders []Contact) {
+	object := objectKadID(owner, name)
+	for _, c := range holders {
+		s.dht.AddProvider(object, c)
+	}
+
+	closest, _ := s.lookup(ctx, object, nil)
+	s.sendContacts(ctx, closest, func() *Message {
+		return &Message{
+			Payload: MessageAddProvider{Object: object, Providers: holders},
+		}
+	})
+}
+
+// findProviders locates the nodes holding an object through the DHT
+func (s *FileServer) findProviders(ctx context.Context, owner, name string) []Contact {
+	_, providers := s.lookup(ctx, objectKadID(owner, name), &MessageFindValue{Owner: owner, Key: name})
+
+	self := s.nodeID()
+	return slices.DeleteFunc(providers, func(c Contact) bool { return c.ID == self })
+}
+
+// connectAll connects to the given contacts other than this node and
+// returns the peers it reached
+func (s *FileServer) connectAll(ctx context.Context, contacts []Contact) []p2p.Peer {
+	self := s.nodeID()
+	peers := []p2p.Peer{}
+	for _, c := range contacts {
+		if c.ID == self {
+			continue
+		}
+		peer, err := s.connect(ctx, c)
+		if err != nil {
+			log.Printf("[%s] connecting to (%s): %v", s.Transport.Addr(), c.ID, err)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// sendContacts sends a message once to each contact in parallel,
+// connecting to them as needed
+func (s *FileServer) sendContacts(ctx context.Context, contacts []Contact, msg func() *Message) {
+	sent := map[string]bool{s.nodeID(): true}
+
+	var wg sync.WaitGroup
+	for _, c := range contacts {
+		if sent[c.ID] {
+			continue
+		}
+		sent[c.ID] = true
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			peer, err := s.connect(ctx, c)
+			if err == nil {
+				err = s.send(peer, msg())
+			}
+			if err != nil {
+				log.Printf("[%s] sending to (%s): %v", s.Transport.Addr(), c.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// isAlive tells whether a node may be reachable: any node membership
+// has not declared dead
+func (s *FileServer) isAlive(id string) bool {
+	state, ok := s.members.State(id)
+	return !ok || state != MemberDead
+}
+
+func (s *FileServer) handleMessageFindNode(from string, msg MessageFindNode) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	resp := Message{
+		Payload: MessageNodes{
+			SeqNo:    msg.SeqNo,
+			Contacts: s.closestExcept(msg.Target, from),
+		},
+	}
+	return s.send(peer, &resp)
+}
+
+func (s *FileServer) handleMessageFindValue(from string, msg MessageFindValue) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	providers := s.dht.Providers(msg.Target)
+	if _, ok := s.servedMeta(msg.Owner, msg.Key); ok {
+		providers = append(providers, s.self())
+	}
+
+	resp := Message{
+		Payload: MessageNodes{
+			SeqNo:     msg.SeqNo,
+			Contacts:  s.closestExcept(msg.Target, from),
+			Providers: providers,
+		},
+	}
+	return s.send(peer, &resp)
+}
+
+func (s *FileServer) handleMessageNodes(from string, msg MessageNodes) error {
+	s.dht.respond(from, msg)
+	return nil
+}
+
+func (s *FileServer) handleMessageAddProvider(from string, msg MessageAddProvider) error {
+	peer, ok := s.peer(from)
+	for _, c := range msg.Providers {
+		if ok && c.ID == from {
+			c.Addr = listenAddr(peer)
+		}
+		s.dht.AddProvider(msg.Object, c)
+	}
+
+	return nil
+}
+
+// closestExcept returns the contacts closest to target other than id
+func (s *FileServer) closestExcept(target kadID, id string) []Contact {
+	contacts := []Contact{}
+	for _, c := range s.dht.Closest(target, s.dht.BucketSize+1) {
+		if c.ID != id {
+			contacts = append(contacts, c)
+		}
+	}
+	if len(contacts) > s.dht.BucketSize {
+		contacts = contacts[:s.dht.BucketSize]
+	}
+	return contacts
+}
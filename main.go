@@ -2,26 +2,129 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"time"
 
 	"github.com/himanshuraimau/drift/p2p"
 )
 
+// encryptionKey returns the key for a node, derived from DRIFT_PASSPHRASE
+// and the cluster name when it is set, otherwise the cluster key in the
+// keyring, sealed with DRIFT_KEYRING_PASSPHRASE. A key is generated and
+// stored in the keyring on first start when there is neither, so it
+// survives restarts and can be escrowed. Without a keyring passphrase to
+// seal it, the generated key is never written and lasts until the node
+// stops.
+func encryptionKey(storageRoot string) []byte {
+	keyring := NewKeyring(storageRoot)
+
+	passphrase := os.Getenv("DRIFT_PASSPHRASE")
+	if len(passphrase) == 0 {
+		secret := keyringPassphrase()
+		key, err := keyring.ClusterKey(secret)
+		if errors.Is(err, os.ErrNotExist) {
+			key = newEncryptionKey()
+			if len(secret) == 0 {
+				log.Printf("neither DRIFT_PASSPHRASE nor DRIFT_KEYRING_PASSPHRASE is set, files stored by %s will not be readable after a restart", storageRoot)
+				return key
+			}
+			if err := keyring.SetClusterKey(key, secret); err != nil {
+				log.Fatalf("storing cluster key: %v", err)
+			}
+			return key
+		}
+		if err != nil {
+			log.Fatalf("loading cluster key: %v", err)
+		}
+		return key
+	}
+
+	key, err := keyring.DeriveClusterKey(clusterName(), passphrase)
+	if err != nil {
+		log.Fatalf("deriving key from passphrase: %v", err)
+	}
+
+	return key
+}
+
+// keyringPassphrase returns the passphrase from DRIFT_KEYRING_PASSPHRASE
+// that seals the cluster key stored in the keyring
+func keyringPassphrase() string {
+	return os.Getenv("DRIFT_KEYRING_PASSPHRASE")
+}
+
+// clusterName returns the name of the cluster a node belongs to, from
+// DRIFT_CLUSTER, which salts the key derived from DRIFT_PASSPHRASE
+func clusterName() string {
+	if name := os.Getenv("DRIFT_CLUSTER"); len(name) > 0 {
+		return name
+	}
+	return defaultClusterName
+}
+
+// tlsConfig returns a mutual TLS config for a node when DRIFT_TLS_DIR is
+// set, issuing its certificate from the cluster CA kept in that directory
+func tlsConfig(nodeID string) *tls.Config {
+	dir := os.Getenv("DRIFT_TLS_DIR")
+	if len(dir) == 0 {
+		return nil
+	}
+
+	ca, err := p2p.LoadOrCreateClusterCA(dir)
+	if err != nil {
+		log.Fatalf("loading cluster CA: %v", err)
+	}
+
+	cert, err := ca.NewNodeCertificate(nodeID, "127.0.0.1", "localhost")
+	if err != nil {
+		log.Fatalf("issuing node certificate: %v", err)
+	}
+
+	return p2p.NewMutualTLSConfig(ca.Pool(), cert, nil)
+}
+
 // makeServer creates a new file server instance
 func makeServer(listenAddr string, nodes ...string) *FileServer {
+	storageRoot := listenAddr + "_network"
+
+	keyring := NewKeyring(storageRoot)
+
+	identityKey, err := keyring.IdentityKey()
+	if err != nil {
+		log.Fatalf("loading identity key: %v", err)
+	}
+
+	exchangeKey, err := keyring.ExchangeKey()
+	if err != nil {
+		log.Fatalf("loading exchange key: %v", err)
+	}
+
+	id := p2p.NodeIDFromKey(identityKey.Public().(ed25519.PublicKey))
+
 	tcpTransportOpts := p2p.TCPTransportOpts{
-		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
+		ListenAddr: listenAddr,
+		HandshakeFunc: p2p.NewIdentityHandshake(p2p.HandshakeConfig{
+			PrivateKey:   identityKey,
+			ListenAddr:   listenAddr,
+			Capabilities: nodeCapabilities,
+		}),
+		Decoder:   p2p.DefaultDecoder{},
+		TLSConfig: tlsConfig(id),
 	}
 	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
 
 	fileServerOpts := FileServerOpts{
-		EncKey:            newEncryptionKey(),
-		StorageRoot:       listenAddr + "_network",
+		ID:                id,
+		EncKey:            encryptionKey(storageRoot),
+		IdentityKey:       identityKey,
+		ExchangeKey:       exchangeKey,
+		StorageRoot:       storageRoot,
 		PathTransformFunc: CASPathTransformFunc,
 		Transport:         tcpTransport,
 		BootstrapNodes:    nodes,
@@ -30,11 +133,19 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 	s := NewFileServer(fileServerOpts)
 
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
 
 	return s
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "key" {
+		if err := runKeyCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Create three nodes
 	s1 := makeServer(":3000", "")
 	s2 := makeServer(":7000", "")
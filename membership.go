@@ -0,0 +1,492 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeInterval    = time.Second
+	defaultProbeTimeout     = 500 * time.Millisecond
+	defaultIndirectProbes   = 3
+	defaultSuspicionTimeout = 5 * time.Second
+	// maxPiggybackUpdates bounds the membership updates carried by one message
+	maxPiggybackUpdates = 8
+	// retransmitMult scales how many messages carry each update, times
+	// the log of the cluster size, so it reaches every member whp
+	retransmitMult = 4
+	// maxIncarnationStep bounds how far ahead of the incarnation this node
+	// knows an update may be. A member only adds one per refutation, so a
+	// larger jump is forged, and could push the member to the end of the
+	// range where it can no longer outbid suspicion.
+	maxIncarnationStep = 1 << 16
+)
+
+// MemberState is what a node believes about another member
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota
+	// MemberSuspect means a probe failed; the member has SuspicionTimeout
+	// to refute it before it is declared dead
+	MemberSuspect
+	MemberDead
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+	return "alive"
+}
+
+// Member is a node of the cluster as seen by this node
+type Member struct {
+	ID    string
+	Addr  string
+	State MemberState
+	// Incarnation is bumped by the member itself to refute suspicion,
+	// and orders updates about it
+	Incarnation uint64
+	// Since is when the member entered its current state
+	Since time.Time
+	// Connected tells whether this node has a connection to the member
+	Connected bool
+}
+
+// MemberUpdate is a change of a member's state, gossiped between nodes
+type MemberUpdate struct {
+	ID          string
+	Addr        string
+	State       MemberState
+	Incarnation uint64
+}
+
+// MembershipOpts configures probing and failure detection
+type MembershipOpts struct {
+	// ProbeInterval is the protocol period: each period one member is
+	// probed, in round-robin order
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long a direct probe waits for an ack before
+	// asking IndirectProbes other peers to probe the member
+	ProbeTimeout   time.Duration
+	IndirectProbes int
+	// SuspicionTimeout is how long a suspect member has to refute the
+	// suspicion before it is declared dead
+	SuspicionTimeout time.Duration
+}
+
+// Membership tracks the members of the cluster with the SWIM rules:
+// updates about a member are ordered by its incarnation, and a member
+// refutes suspicion about itself by gossiping a newer incarnation. Changes
+// are queued for dissemination on the messages the node sends anyway.
+type Membership struct {
+	MembershipOpts
+
+	mu          sync.Mutex
+	self        Member
+	members     map[string]*Member
+	queue       map[string]*gossipItem
+	probeOrder  []string
+	probeNext   int
+	seqNo       uint64
+	pendingAcks map[uint64]*pendingAck
+}
+
+// pendingAck is a probe waiting for an ack from one of the given members:
+// the member probed, or one asked to probe it
+type pendingAck struct {
+	from  []string
+	acked chan struct{}
+}
+
+// gossipItem is an update waiting to be piggybacked
+type gossipItem struct {
+	update    MemberUpdate
+	transmits int
+}
+
+// NewMembership creates the membership of the node with the given ID,
+// listening on addr, knowing only itself
+func NewMembership(id, addr string, opts MembershipOpts) *Membership {
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = defaultProbeInterval
+	}
+	if opts.ProbeTimeout <= 0 || opts.ProbeTimeout >= opts.ProbeInterval {
+		opts.ProbeTimeout = min(defaultProbeTimeout, opts.ProbeInterval/2)
+	}
+	if opts.IndirectProbes <= 0 {
+		opts.IndirectProbes = defaultIndirectProbes
+	}
+	if opts.SuspicionTimeout <= 0 {
+		opts.SuspicionTimeout = defaultSuspicionTimeout
+	}
+
+	return &Membership{
+		MembershipOpts: opts,
+		self:           Member{ID: id, Addr: addr, State: MemberAlive, Since: time.Now()},
+		members:        make(map[string]*Member),
+		queue:          make(map[string]*gossipItem),
+		pendingAcks:    make(map[uint64]*pendingAck),
+	}
+}
+
+// Members returns every known member including this node, sorted by ID
+func (m *Membership) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := []Member{m.self}
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+
+	return members
+}
+
+// Member returns what this node knows about a member
+func (m *Membership) Member(id string) (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id == m.self.ID {
+		return m.self, true
+	}
+	member, ok := m.members[id]
+	if !ok {
+		return Member{}, false
+	}
+	return *member, true
+}
+
+// Live returns the IDs of the members not declared dead, including this
+// node, sorted
+func (m *Membership) Live() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := []string{m.self.ID}
+	for id, member := range m.members {
+		if member.State != MemberDead {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// State returns the state of a member
+func (m *Membership) State(id string) (MemberState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id == m.self.ID {
+		return m.self.State, true
+	}
+	member, ok := m.members[id]
+	if !ok {
+		return MemberDead, false
+	}
+	return member.State, true
+}
+
+// Join records a member this node has connected to. A member believed to
+// be suspect or dead has its state gossiped again so it hears and refutes it.
+func (m *Membership) Join(id, addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id == m.self.ID {
+		return
+	}
+
+	member, ok := m.members[id]
+	if !ok {
+		m.set(MemberUpdate{ID: id, Addr: addr, State: MemberAlive})
+		m.members[id].Connected = true
+		return
+	}
+	if len(addr) > 0 {
+		member.Addr = addr
+	}
+	member.Connected = true
+	if member.State != MemberAlive {
+		m.enqueue(member)
+	}
+}
+
+// Leave records that the connection to a member is gone. It says nothing
+// about whether the member is alive.
+func (m *Membership) Leave(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if member, ok := m.members[id]; ok {
+		member.Connected = false
+	}
+}
+
+// Apply merges an update from another node and reports whether it changed
+// this node's view
+func (m *Membership) Apply(u MemberUpdate) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u.ID == m.self.ID {
+		if u.State == MemberAlive || !incarnationInRange(m.self.Incarnation, u.Incarnation) {
+			return false
+		}
+
+		// Refute anything but alive by outbidding its incarnation, and
+		// repeat an earlier refutation to a node that missed it
+		refuted := u.Incarnation >= m.self.Incarnation
+		if refuted {
+			m.self.Incarnation = u.Incarnation + 1
+		}
+		m.enqueue(&m.self)
+		return refuted
+	}
+
+	member, ok := m.members[u.ID]
+	if !ok {
+		if !incarnationInRange(0, u.Incarnation) {
+			return false
+		}
+		m.set(u)
+		return true
+	}
+	if !incarnationInRange(member.Incarnation, u.Incarnation) {
+		return false
+	}
+
+	newer := u.Incarnation > member.Incarnation
+	switch u.State {
+	case MemberAlive:
+		if !newer {
+			return false
+		}
+	case MemberSuspect:
+		if !newer && (member.State != MemberAlive || u.Incarnation < member.Incarnation) {
+			return false
+		}
+	case MemberDead:
+		if !newer && (member.State == MemberDead || u.Incarnation < member.Incarnation) {
+			return false
+		}
+	}
+
+	m.set(u)
+	return true
+}
+
+// incarnationInRange reports whether a member known at incarnation known
+// could have reached incarnation u
+func incarnationInRange(known, u uint64) bool {
+	return u <= known || u-known <= maxIncarnationStep
+}
+
+// Suspect marks a member that failed a probe as suspect and reports
+// whether it was alive
+func (m *Membership) Suspect(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member, ok := m.members[id]
+	if !ok || member.State != MemberAlive {
+		return false
+	}
+
+	m.set(MemberUpdate{ID: id, State: MemberSuspect, Incarnation: member.Incarnation})
+	return true
+}
+
+// ExpireSuspects declares members dead that stayed suspect for
+// SuspicionTimeout and returns their IDs
+func (m *Membership) ExpireSuspects() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dead := []string{}
+	for id, member := range m.members {
+		if member.State == MemberSuspect && time.Since(member.Since) >= m.SuspicionTimeout {
+			m.set(MemberUpdate{ID: id, State: MemberDead, Incarnation: member.Incarnation})
+			dead = append(dead, id)
+		}
+	}
+
+	return dead
+}
+
+// Snapshot returns the full state of every member including this node,
+// sent to nodes that connect so they need not wait for gossip
+func (m *Membership) Snapshot() []MemberUpdate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	updates := []MemberUpdate{m.self.update()}
+	for _, member := range m.members {
+		updates = append(updates, member.update())
+	}
+
+	return updates
+}
+
+// Gossip returns the updates to piggyback on the next message. Each update
+// is sent a number of times that grows with the log of the cluster size.
+func (m *Membership) Gossip() []MemberUpdate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.queue) == 0 {
+		return nil
+	}
+
+	items := make([]*gossipItem, 0, len(m.queue))
+	for _, item := range m.queue {
+		items = append(items, item)
+	}
+	// Fresh updates first
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].transmits < items[j].transmits
+	})
+	if len(items) > maxPiggybackUpdates {
+		items = items[:maxPiggybackUpdates]
+	}
+
+	limit := retransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+2))))
+	updates := make([]MemberUpdate, 0, len(items))
+	for _, item := range items {
+		updates = append(updates, item.update)
+		item.transmits++
+		if item.transmits >= limit {
+			delete(m.queue, item.update.ID)
+		}
+	}
+
+	return updates
+}
+
+// nextProbeTarget returns the next member to probe, going round-robin
+// through the live members in a random order reshuffled every round. Dead
+// members are still probed while connected, so the probes carry the news
+// of their death to them and they can refute it.
+func (m *Membership) nextProbeTarget() (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		if m.probeNext >= len(m.probeOrder) {
+			m.probeOrder = m.probeOrder[:0]
+			for id, member := range m.members {
+				if member.probed() {
+					m.probeOrder = append(m.probeOrder, id)
+				}
+			}
+			if len(m.probeOrder) == 0 {
+				return "", false
+			}
+			rand.Shuffle(len(m.probeOrder), func(i, j int) {
+				m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+			})
+			m.probeNext = 0
+		}
+
+		id := m.probeOrder[m.probeNext]
+		m.probeNext++
+		if member, ok := m.members[id]; ok && member.probed() {
+			return id, true
+		}
+	}
+}
+
+// expectAck returns a new probe sequence number and a channel closed when
+// its ack arrives from one of the given members
+func (m *Membership) expectAck(from ...string) (uint64, chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seqNo++
+	acked := make(chan struct{})
+	m.pendingAcks[m.seqNo] = &pendingAck{from: from, acked: acked}
+	return m.seqNo, acked
+}
+
+// allowAck lets a member, asked to probe another, ack a probe too
+func (m *Membership) allowAck(seqNo uint64, from string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pending, ok := m.pendingAcks[seqNo]; ok {
+		pending.from = append(pending.from, from)
+	}
+}
+
+// ack records the ack of a probe sent by from, ignoring it unless from is
+// a member the probe expects an ack from
+func (m *Membership) ack(seqNo uint64, from string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pending, ok := m.pendingAcks[seqNo]; ok && slices.Contains(pending.from, from) {
+		close(pending.acked)
+		delete(m.pendingAcks, seqNo)
+	}
+}
+
+// forgetAck stops waiting for the ack of a probe
+func (m *Membership) forgetAck(seqNo uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.pendingAcks, seqNo)
+}
+
+// set changes a member's state and queues the change; m.mu must be held
+func (m *Membership) set(u MemberUpdate) {
+	member, ok := m.members[u.ID]
+	if !ok {
+		member = &Member{ID: u.ID}
+		m.members[u.ID] = member
+	}
+	// An address learned by connecting beats one a member reports itself
+	if len(member.Addr) == 0 {
+		member.Addr = u.Addr
+	}
+	if !ok || member.State != u.State {
+		member.Since = time.Now()
+	}
+	member.State = u.State
+	member.Incarnation = u.Incarnation
+
+	m.enqueue(member)
+}
+
+// enqueue queues a member's state for gossip, replacing older news about
+// it; m.mu must be held
+func (m *Membership) enqueue(member *Member) {
+	m.queue[member.ID] = &gossipItem{update: member.update()}
+}
+
+func (member *Member) probed() bool {
+	return member.State != MemberDead || member.Connected
+}
+
+func (member *Member) update() MemberUpdate {
+	return MemberUpdate{
+		ID:          member.ID,
+		Addr:        member.Addr,
+		State:       member.State,
+		Incarnation: member.Incarnation,
+	}
+}
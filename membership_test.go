@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembershipApply(t *testing.T) {
+	m := NewMembership("self", "node0", MembershipOpts{SuspicionTimeout: time.Millisecond})
+	m.Join("a", "node1")
+
+	state := func() MemberState {
+		st, ok := m.State("a")
+		assert.True(t, ok, "Member should be known")
+		return st
+	}
+
+	assert.True(t, m.Apply(MemberUpdate{ID: "a", State: MemberSuspect}), "Suspicion should override alive at the same incarnation")
+	assert.Equal(t, MemberSuspect, state(), "Member should be suspect")
+	assert.False(t, m.Apply(MemberUpdate{ID: "a", State: MemberAlive}), "Alive should not override suspicion at the same incarnation")
+	assert.True(t, m.Apply(MemberUpdate{ID: "a", State: MemberAlive, Incarnation: 1}), "Refutation should override suspicion")
+	assert.Equal(t, MemberAlive, state(), "Member should be alive again")
+	assert.False(t, m.Apply(MemberUpdate{ID: "a", State: MemberDead}), "Stale death should be ignored")
+
+	assert.True(t, m.Suspect("a"), "Failed probe should make the member suspect")
+	time.Sleep(2 * time.Millisecond)
+	assert.Equal(t, []string{"a"}, m.ExpireSuspects(), "Unrefuted suspicion should expire")
+	assert.Equal(t, MemberDead, state(), "Member should be dead")
+	_, ok := m.nextProbeTarget()
+	assert.True(t, ok, "Dead members should be probed while connected")
+	m.Leave("a")
+	_, ok = m.nextProbeTarget()
+	assert.False(t, ok, "Dead members should not be probed once disconnected")
+
+	// Suspicion about this node is refuted with a newer incarnation
+	assert.True(t, m.Apply(MemberUpdate{ID: "self", State: MemberSuspect, Incarnation: 3}), "Suspicion about self should be refuted")
+	refuted := false
+	for _, u := range m.Gossip() {
+		if u.ID == "self" {
+			refuted = u.State == MemberAlive && u.Incarnation == 4
+		}
+	}
+	assert.True(t, refuted, "Refutation should be gossiped")
+
+	// Incarnations out of reach of any refutation are forged
+	assert.False(t, m.Apply(MemberUpdate{ID: "self", State: MemberSuspect, Incarnation: math.MaxUint64}), "Suspicion far ahead of this node should be ignored")
+	assert.False(t, m.Apply(MemberUpdate{ID: "a", State: MemberAlive, Incarnation: math.MaxUint64}), "Update far ahead of the member should be ignored")
+	assert.False(t, m.Apply(MemberUpdate{ID: "b", State: MemberDead, Incarnation: math.MaxUint64}), "Unknown member far ahead should be ignored")
+	for _, u := range m.Gossip() {
+		assert.LessOrEqual(t, u.Incarnation, uint64(maxIncarnationStep), "Forged incarnation should not be gossiped")
+	}
+}
+
+func TestMembershipAckFromProbedMember(t *testing.T) {
+	m := NewMembership("self", "node0", MembershipOpts{})
+
+	seqNo, acked := m.expectAck("a")
+	m.ack(seqNo, "spy")
+	select {
+	case <-acked:
+		t.Fatal("Ack from another member should be ignored")
+	default:
+	}
+
+	// A member asked to probe "a" relays its ack
+	m.allowAck(seqNo, "b")
+	m.ack(seqNo, "b")
+	select {
+	case <-acked:
+	default:
+		t.Fatal("Ack relayed by a member asked to probe should count")
+	}
+}
+
+func TestMembershipFailureDetection(t *testing.T) {
+	faults := p2p.NewFaultInjector(1)
+	servers := startCluster(t, 4, faults)
+	isolated := servers[3]
+
+	// memberStates reports whether every server but skip sees id in state
+	memberStates := func(id string, want MemberState, skip *FileServer) bool {
+		for _, s := range servers {
+			if s == skip {
+				continue
+			}
+			if st, ok := s.members.State(id); !ok || st != want {
+				return false
+			}
+		}
+		return true
+	}
+
+	waitForCluster(t, len(servers), func() bool {
+		for _, s := range servers {
+			if !memberStates(s.nodeID(), MemberAlive, nil) {
+				return false
+			}
+		}
+		return true
+	}, "every node should see every member alive")
+	assert.Len(t, servers[0].Members(), 4, "Members should include this node")
+
+	faults.Partition("minority", "node3")
+	waitForCluster(t, len(servers), func() bool {
+		return memberStates(isolated.nodeID(), MemberDead, isolated)
+	}, "isolated member should be declared dead")
+
+	// Once the partition heals the member refutes its death
+	faults.Heal("minority")
+	waitForCluster(t, len(servers), func() bool {
+		return memberStates(isolated.nodeID(), MemberAlive, nil)
+	}, "member should be alive again after the partition heals")
+
+	for _, m := range servers[0].Members() {
+		if m.ID == isolated.nodeID() {
+			assert.Greater(t, m.Incarnation, uint64(0), "Refutation should bump the incarnation")
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"slices"
+	"strings"
+)
+
+const (
+	// merkleFanout is how many children every inner node of a Merkle
+	// tree has
+	merkleFanout = 16
+	// merkleDepth is how many levels a Merkle tree has below its root.
+	// The fanout to this power is 256, so the leaves are buckets picked
+	// by the first byte of an object's ID.
+	merkleDepth = 2
+	// merkleBuckets is how many leaves a Merkle tree has
+	merkleBuckets = 256
+)
+
+// SyncEntry is the version of an object, or of its deletion, that
+// anti-entropy compares between replicas
+type SyncEntry struct {
+	ID  string
+	Key string
+	// Timestamp is the version: when the object was signed, or deleted
+	Timestamp int64
+	// Hash is the hash of the replica; deletions have none
+	Hash   []byte
+	Author ed25519.PublicKey
+	// Deleted marks a tombstone
+	Deleted bool
+	Secure  bool
+	// Signature is the owner's signature of a tombstone
+	Signature []byte
+}
+
+// tombstone returns the tombstone a deletion entry carries
+func (e SyncEntry) tombstone() Tombstone {
+	return Tombstone{
+		ID:        e.ID,
+		Key:       e.Key,
+		Timestamp: e.Timestamp,
+		Secure:    e.Secure,
+		Author:    e.Author,
+		Signature: e.Signature,
+	}
+}
+
+// newer reports whether e supersedes other. Deletions win ties with the
+// object they delete, and replicas signed at the same time are ordered by
+// hash, so every node picks the same winner.
+func (e SyncEntry) newer(other SyncEntry) bool {
+	if e.Timestamp != other.Timestamp {
+		return e.Timestamp > other.Timestamp
+	}
+	if e.Deleted != other.Deleted {
+		return e.Deleted
+	}
+	return bytes.Compare(e.Hash, other.Hash) > 0
+}
+
+// bucket returns the leaf of a Merkle tree an entry belongs to
+func (e SyncEntry) bucket() int {
+	return int(objectKadID(e.ID, e.Key)[0])
+}
+
+// writeTo hashes the fields that make up an entry's version
+func (e SyncEntry) writeTo(h hash.Hash) {
+	h.Write([]byte(e.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(e.Key))
+	h.Write([]byte{0})
+	binary.Write(h, binary.LittleEndian, e.Timestamp)
+	if e.Deleted {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	h.Write(e.Hash)
+}
+
+// MerkleTree hashes a node's key/version space so two nodes can find the
+// objects they disagree on by comparing a few hashes instead of every
+// version
+type MerkleTree struct {
+	// levels[0] holds the root and levels[merkleDepth] the leaves
+	levels  [][][]byte
+	buckets [][]SyncEntry
+}
+
+// NewMerkleTree builds the Merkle tree of a set of entries
+func NewMerkleTree(entries []SyncEntry) *MerkleTree {
+	t := &MerkleTree{
+		levels:  make([][][]byte, merkleDepth+1),
+		buckets: make([][]SyncEntry, merkleBuckets),
+	}
+
+	for _, e := range entries {
+		b := e.bucket()
+		t.buckets[b] = append(t.buckets[b], e)
+	}
+
+	leaves := make([][]byte, merkleBuckets)
+	for i, bucket := range t.buckets {
+		slices.SortFunc(bucket, func(a, b SyncEntry) int {
+			if c := strings.Compare(a.ID, b.ID); c != 0 {
+				return c
+			}
+			return strings.Compare(a.Key, b.Key)
+		})
+
+		h := sha256.New()
+		for _, e := range bucket {
+			e.writeTo(h)
+		}
+		leaves[i] = h.Sum(nil)
+	}
+	t.levels[merkleDepth] = leaves
+
+	for level := merkleDepth - 1; level >= 0; level-- {
+		children := t.levels[level+1]
+		nodes := make([][]byte, len(children)/merkleFanout)
+		for i := range nodes {
+			h := sha256.New()
+			for _, child := range children[i*merkleFanout : (i+1)*merkleFanout] {
+				h.Write(child)
+			}
+			nodes[i] = h.Sum(nil)
+		}
+		t.levels[level] = nodes
+	}
+
+	return t
+}
+
+// Root returns the hash of the whole tree
+func (t *MerkleTree) Root() []byte {
+	return t.levels[0][0]
+}
+
+// Hash returns the hash of a node, or nil if there is no such node
+func (t *MerkleTree) Hash(level, index int) []byte {
+	if level < 0 || level > merkleDepth || index < 0 || index >= len(t.levels[level]) {
+		return nil
+	}
+	return t.levels[level][index]
+}
+
+// Bucket returns the entries of a leaf
+func (t *MerkleTree) Bucket(index int) []SyncEntry {
+	if index < 0 || index >= merkleBuckets {
+		return nil
+	}
+	return t.buckets[index]
+}
+
+// merkleChildren returns the indices of the children of inner nodes on
+// the level below them
+func merkleChildren(nodes []int) []int {
+	children := make([]int, 0, len(nodes)*merkleFanout)
+	for _, n := range nodes {
+		for i := range merkleFanout {
+			children = append(children, n*merkleFanout+i)
+		}
+	}
+	return children
+}
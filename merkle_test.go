@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerkleTreeFindsDifferingBuckets(t *testing.T) {
+	entries := []SyncEntry{}
+	for i := range 100 {
+		entries = append(entries, SyncEntry{ID: "owner", Key: fmt.Sprintf("key%d", i), Timestamp: int64(i), Hash: []byte{byte(i)}})
+	}
+
+	a := NewMerkleTree(entries)
+	// Order does not matter
+	reversed := make([]SyncEntry, len(entries))
+	for i, e := range entries {
+		reversed[len(entries)-1-i] = e
+	}
+	b := NewMerkleTree(reversed)
+	assert.Equal(t, a.Root(), b.Root(), "Trees of the same entries should have the same root")
+
+	changed := entries[42]
+	changed.Timestamp++
+	modified := append([]SyncEntry{}, entries...)
+	modified[42] = changed
+	c := NewMerkleTree(modified)
+	assert.NotEqual(t, a.Root(), c.Root(), "Trees of different versions should have different roots")
+
+	// Descending from the root leads to the one bucket that changed
+	nodes := []int{0}
+	for level := 0; level <= merkleDepth; level++ {
+		differing := []int{}
+		for _, n := range nodes {
+			if !bytes.Equal(a.Hash(level, n), c.Hash(level, n)) {
+				differing = append(differing, n)
+			}
+		}
+		nodes = differing
+		if level < merkleDepth {
+			nodes = merkleChildren(differing)
+		}
+	}
+	assert.Equal(t, []int{changed.bucket()}, nodes, "Only the bucket of the changed entry should differ")
+	assert.Contains(t, c.Bucket(changed.bucket()), changed, "Bucket should hold the changed entry")
+}
+
+func TestSyncEntryNewer(t *testing.T) {
+	old := SyncEntry{Timestamp: 1, Hash: []byte{1}}
+	updated := SyncEntry{Timestamp: 2, Hash: []byte{2}}
+	deleted := SyncEntry{Timestamp: 2, Deleted: true}
+
+	assert.True(t, updated.newer(old), "Later version should be newer")
+	assert.False(t, old.newer(updated), "Earlier version should not be newer")
+	assert.True(t, deleted.newer(updated), "Delete should win a tie with the version it deletes")
+	assert.False(t, updated.newer(updated), "Version should not be newer than itself")
+}
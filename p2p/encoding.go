@@ -18,30 +18,23 @@ func (dec GOBDecoder) Decode(r io.Reader, rpc *RPC) error {
 	return gob.NewDecoder(r).Decode(rpc)
 }
 
-// DefaultDecoder is the default decoder implementation
+// DefaultDecoder is the default decoder implementation. It reads one
+// length-prefixed, checksummed frame per call.
 type DefaultDecoder struct{}
 
 func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
+	msg, err := ReadMessage(r)
+	if err != nil {
 		return err
 	}
 
-	// In case of a stream we are not decoding what is being sent over the network
-	// We are just setting stream true so we can handle that in our logic.
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		rpc.Stream = true
-		return nil
-	}
-
-	buf := make([]byte, 1024)
-	n, err := r.Read(buf)
-	if err != nil {
-		return err
+	if msg.Header.Type != IncomingMessage && msg.Header.Type != IncomingHeartbeat && !isStreamFrame(msg.Header.Type) {
+		return fmt.Errorf("unknown frame type: %#x", msg.Header.Type)
 	}
 
-	rpc.Payload = buf[:n]
+	rpc.Type = msg.Header.Type
+	rpc.StreamID = msg.Header.StreamID
+	rpc.Payload = msg.Data
 
 	return nil
 }
@@ -58,25 +51,18 @@ func (enc GOBEncoder) Encode(w io.Writer, rpc *RPC) error {
 	return gob.NewEncoder(w).Encode(rpc)
 }
 
-// DefaultEncoder is the default encoder implementation
+// DefaultEncoder is the default encoder implementation, the counterpart
+// of DefaultDecoder
 type DefaultEncoder struct{}
 
 func (enc DefaultEncoder) Encode(w io.Writer, rpc *RPC) error {
-	if rpc.Stream {
-		// For streams, we just write the stream indicator
-		_, err := w.Write([]byte{IncomingStream})
-		return err
-	}
-
-	// For regular messages, write the message indicator followed by the payload
-	if _, err := w.Write([]byte{IncomingMessage}); err != nil {
-		return err
+	if isStreamFrame(rpc.Type) || rpc.Type == IncomingHeartbeat {
+		return WriteMessage(w, NewStreamMessage(rpc.Type, rpc.StreamID, rpc.Payload))
 	}
 
 	if len(rpc.Payload) == 0 {
 		return fmt.Errorf("empty payload")
 	}
 
-	_, err := w.Write(rpc.Payload)
-	return err
-}
\ No newline at end of file
+	return WriteMessage(w, NewMessage(IncomingMessage, rpc.Payload))
+}
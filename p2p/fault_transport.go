@@ -0,0 +1,360 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is returned by connections a FaultInjector broke
+var ErrInjectedFault = errors.New("injected network fault")
+
+// Faults are the impairments applied to the messages a node sends
+type Faults struct {
+	// Latency delays every message the node sends, and every stream it
+	// opens
+	Latency time.Duration
+	// Bandwidth caps how many bytes per second of messages each peer
+	// is sent; zero means unlimited
+	Bandwidth int
+	// DisconnectRate is the probability that a message closes the
+	// connection instead of being sent
+	DisconnectRate float64
+	// CorruptRate is the probability that a message is corrupted on the
+	// way. Frames are checksummed, so the receiver would drop the
+	// connection: the connection is closed instead of delivering it.
+	CorruptRate float64
+}
+
+// FaultInjector controls the faults of every transport decorated with
+// NewFaultyTransport, so tests can change them while a cluster runs.
+// Nodes are named by the address their transport listens on.
+type FaultInjector struct {
+	mu         sync.Mutex
+	rand       *rand.Rand
+	defaults   Faults
+	nodes      map[string]Faults
+	partitions map[string]map[string]bool
+	peers      map[*faultyPeer]struct{}
+}
+
+// NewFaultInjector creates a fault injector without faults. The seed
+// makes the random faults repeatable.
+func NewFaultInjector(seed uint64) *FaultInjector {
+	return &FaultInjector{
+		rand:       rand.New(rand.NewPCG(seed, seed)),
+		nodes:      make(map[string]Faults),
+		partitions: make(map[string]map[string]bool),
+		peers:      make(map[*faultyPeer]struct{}),
+	}
+}
+
+// SetFaults sets the faults of every node without faults of its own
+func (f *FaultInjector) SetFaults(faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.defaults = faults
+}
+
+// SetNodeFaults sets the faults of the data sent by a single node
+func (f *FaultInjector) SetNodeFaults(node string, faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nodes[node] = faults
+}
+
+// ClearFaults removes all faults, leaving partitions in place
+func (f *FaultInjector) ClearFaults() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.defaults = Faults{}
+	f.nodes = make(map[string]Faults)
+}
+
+// Partition cuts the given nodes off from every node outside of them
+// until the partition is healed. Existing connections across it are
+// closed, new ones are refused by both the dialing and the accepting
+// side, and messages across it are dropped.
+func (f *FaultInjector) Partition(name string, nodes ...string) {
+	f.mu.Lock()
+	members := make(map[string]bool)
+	for _, node := range nodes {
+		members[node] = true
+	}
+	f.partitions[name] = members
+
+	var cut []*faultyPeer
+	for peer := range f.peers {
+		if f.partitioned(peer.local, peer.remote) {
+			cut = append(cut, peer)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, peer := range cut {
+		peer.Close()
+	}
+}
+
+// Heal removes a named partition. Nodes have to reconnect themselves.
+func (f *FaultInjector) Heal(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.partitions, name)
+}
+
+// partitioned reports whether a partition separates two nodes; f.mu
+// must be held. A node whose name is not known is in no partition.
+func (f *FaultInjector) partitioned(a, b string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	for _, members := range f.partitions {
+		if members[a] != members[b] {
+			return true
+		}
+	}
+	return false
+}
+
+// cut reports whether a partition separates two nodes
+func (f *FaultInjector) cut(a, b string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.partitioned(a, b)
+}
+
+// faults returns the faults of a node and rolls the random ones for a
+// single write
+func (f *FaultInjector) faults(node string) (faults Faults, disconnect bool, corrupt bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	faults, ok := f.nodes[node]
+	if !ok {
+		faults = f.defaults
+	}
+
+	disconnect = faults.DisconnectRate > 0 && f.rand.Float64() < faults.DisconnectRate
+	corrupt = faults.CorruptRate > 0 && f.rand.Float64() < faults.CorruptRate
+
+	return faults, disconnect, corrupt
+}
+
+func (f *FaultInjector) track(peer *faultyPeer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.peers[peer] = struct{}{}
+}
+
+func (f *FaultInjector) untrack(peer *faultyPeer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.peers, peer)
+}
+
+// FaultyTransport decorates a transport so the peers it connects to
+// suffer the faults of a FaultInjector. The decorated transport hands
+// its peers to the callbacks wrapped by WrapOnPeer and
+// WrapOnPeerDisconnect, which see them decorated.
+type FaultyTransport struct {
+	Transport
+	injector *FaultInjector
+	rpcch    chan RPC
+	closech  chan struct{}
+
+	mu sync.Mutex
+	// peers are the decorated peers by the peer they decorate, and
+	// remotes the node names of the peers by ID
+	peers     map[Peer]*faultyPeer
+	remotes   map[string]string
+	closeOnce sync.Once
+}
+
+// NewFaultyTransport decorates t, naming its node by t.Addr(), with the
+// faults injected by f. Both ends of a connection enforce partitions, so
+// a partitioned node is cut off even from nodes that are not decorated.
+func NewFaultyTransport(t Transport, f *FaultInjector) *FaultyTransport {
+	ft := &FaultyTransport{
+		Transport: t,
+		injector:  f,
+		rpcch:     make(chan RPC, 1024),
+		closech:   make(chan struct{}),
+		peers:     make(map[Peer]*faultyPeer),
+		remotes:   make(map[string]string),
+	}
+	go ft.forward()
+
+	return ft
+}
+
+// Dial implements the Transport interface, refusing to dial across a
+// partition
+func (t *FaultyTransport) Dial(addr string) error {
+	if t.injector.cut(t.Addr(), addr) {
+		return fmt.Errorf("dial %s: %w: partitioned", addr, ErrInjectedFault)
+	}
+	return t.Transport.Dial(addr)
+}
+
+// Consume implements the Transport interface, dropping the messages of
+// peers across a partition
+func (t *FaultyTransport) Consume() <-chan RPC {
+	return t.rpcch
+}
+
+// Close implements the Transport interface
+func (t *FaultyTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.closech) })
+	return t.Transport.Close()
+}
+
+// forward passes on the messages received by the decorated transport
+func (t *FaultyTransport) forward() {
+	for {
+		select {
+		case rpc := <-t.Transport.Consume():
+			t.mu.Lock()
+			remote := t.remotes[rpc.From]
+			t.mu.Unlock()
+			if t.injector.cut(t.Addr(), remote) {
+				continue
+			}
+
+			select {
+			case t.rpcch <- rpc:
+			case <-t.closech:
+				return
+			}
+		case <-t.closech:
+			return
+		}
+	}
+}
+
+// WrapOnPeer returns an OnPeer callback for the decorated transport that
+// hands onPeer the peer decorated, unless a partition separates it
+func (t *FaultyTransport) WrapOnPeer(onPeer func(Peer) error) func(Peer) error {
+	return func(p Peer) error {
+		// Only a peer that dialed knows the name of the node it reached
+		// before the handshake tells it
+		remote := p.Info().ListenAddr
+		if len(remote) == 0 && p.Outbound() {
+			remote = p.RemoteAddr().String()
+		}
+		if t.injector.cut(t.Addr(), remote) {
+			return fmt.Errorf("accept %s: %w: partitioned", remote, ErrInjectedFault)
+		}
+
+		fp := &faultyPeer{Peer: p, injector: t.injector, local: t.Addr(), remote: remote}
+		t.injector.track(fp)
+		t.mu.Lock()
+		t.peers[p] = fp
+		t.remotes[PeerID(p)] = remote
+		t.mu.Unlock()
+
+		if onPeer == nil {
+			return nil
+		}
+		if err := onPeer(fp); err != nil {
+			t.forget(p)
+			return err
+		}
+		return nil
+	}
+}
+
+// WrapOnPeerDisconnect returns an OnPeerDisconnect callback for the
+// decorated transport that hands onPeerDisconnect the decorated peer
+func (t *FaultyTransport) WrapOnPeerDisconnect(onPeerDisconnect func(Peer, error)) func(Peer, error) {
+	return func(p Peer, err error) {
+		fp := t.forget(p)
+		if fp == nil || onPeerDisconnect == nil {
+			return
+		}
+		onPeerDisconnect(fp, err)
+	}
+}
+
+// forget stops tracking a peer and returns its decoration
+func (t *FaultyTransport) forget(p Peer) *faultyPeer {
+	t.mu.Lock()
+	fp, ok := t.peers[p]
+	delete(t.peers, p)
+	t.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	t.injector.untrack(fp)
+	return fp
+}
+
+// faultyPeer applies the local node's faults to the messages sent to a
+// peer, and the partitions between the two
+type faultyPeer struct {
+	Peer
+	injector *FaultInjector
+	local    string
+	remote   string
+}
+
+// Send implements the Peer interface
+func (p *faultyPeer) Send(b []byte) error {
+	if p.injector.cut(p.local, p.remote) {
+		p.Close()
+		return fmt.Errorf("%w: partitioned", ErrInjectedFault)
+	}
+
+	faults, disconnect, corrupt := p.injector.faults(p.local)
+
+	if disconnect {
+		p.Close()
+		return fmt.Errorf("%w: disconnected", ErrInjectedFault)
+	}
+
+	delay := faults.Latency
+	if faults.Bandwidth > 0 {
+		delay += time.Duration(len(b)) * time.Second / time.Duration(faults.Bandwidth)
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	// The receiver would fail the frame's checksum and drop the
+	// connection; the sender does not find out until its next write
+	if corrupt {
+		p.Close()
+		return nil
+	}
+
+	return p.Peer.Send(b)
+}
+
+// OpenStream implements the Peer interface
+func (p *faultyPeer) OpenStream() (*Stream, error) {
+	if p.injector.cut(p.local, p.remote) {
+		p.Close()
+		return nil, fmt.Errorf("%w: partitioned", ErrInjectedFault)
+	}
+
+	faults, disconnect, _ := p.injector.faults(p.local)
+	if disconnect {
+		p.Close()
+		return nil, fmt.Errorf("%w: disconnected", ErrInjectedFault)
+	}
+	if faults.Latency > 0 {
+		time.Sleep(faults.Latency)
+	}
+
+	return p.Peer.OpenStream()
+}
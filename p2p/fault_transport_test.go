@@ -0,0 +1,153 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// faultyPair returns two connected faulty transports on a memory network,
+// node1 and node2, and node1's and node2's view of the connection
+func faultyPair(t *testing.T, f *FaultInjector) (*FaultyTransport, *FaultyTransport, Peer, Peer) {
+	network := NewMemoryNetwork()
+	peers := make(chan Peer, 2)
+	newTransport := func(addr string) *FaultyTransport {
+		mt := NewMemoryTransport(network, TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+		})
+		tr := NewFaultyTransport(mt, f)
+		mt.OnPeer = tr.WrapOnPeer(func(p Peer) error {
+			peers <- p
+			return nil
+		})
+		mt.OnPeerDisconnect = tr.WrapOnPeerDisconnect(nil)
+		assert.NoError(t, tr.ListenAndAccept(), "Listening should not error")
+		t.Cleanup(func() { tr.Close() })
+		return tr
+	}
+
+	tr1 := newTransport("node1")
+	tr2 := newTransport("node2")
+	assert.NoError(t, tr1.Dial("node2"), "Dialing should not error")
+
+	p1, p2 := <-peers, <-peers
+	if p1.RemoteAddr().String() != "node2" {
+		p1, p2 = p2, p1
+	}
+
+	return tr1, tr2, p1, p2
+}
+
+func TestFaultyTransportLatency(t *testing.T) {
+	f := NewFaultInjector(1)
+	_, tr2, p1, _ := faultyPair(t, f)
+
+	f.SetNodeFaults("node1", Faults{Latency: 50 * time.Millisecond, Bandwidth: 64 * 1024})
+
+	start := time.Now()
+	assert.NoError(t, p1.Send(make([]byte, 32*1024)), "Sending should not error")
+	msg := <-tr2.Consume()
+	assert.Len(t, msg.Payload, 32*1024, "Message should arrive intact")
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond, "Latency and bandwidth cap should slow the write")
+}
+
+func TestFaultyTransportCorruption(t *testing.T) {
+	f := NewFaultInjector(1)
+	_, tr2, p1, p2 := faultyPair(t, f)
+
+	f.SetFaults(Faults{CorruptRate: 1})
+	p1.Send([]byte("corrupted"))
+
+	// The checksum catches the corruption and the connection is dropped
+	// instead of delivering the message
+	stream, err := p2.OpenStream()
+	if err == nil {
+		_, err = stream.Read(make([]byte, 1))
+	}
+	assert.Error(t, err, "Connection should be dropped after a corrupted frame")
+	assert.Empty(t, tr2.Consume(), "Corrupted message should not be delivered")
+}
+
+func TestFaultyTransportDisconnect(t *testing.T) {
+	f := NewFaultInjector(1)
+	_, _, p1, _ := faultyPair(t, f)
+
+	f.SetNodeFaults("node1", Faults{DisconnectRate: 1})
+	assert.ErrorIs(t, p1.Send([]byte("lost")), ErrInjectedFault, "Write should fail with a disconnect")
+
+	f.ClearFaults()
+	assert.Error(t, p1.Send([]byte("after")), "Connection should stay closed")
+}
+
+func TestFaultyTransportPartition(t *testing.T) {
+	f := NewFaultInjector(1)
+	tr1, _, p1, _ := faultyPair(t, f)
+
+	f.Partition("split", "node1")
+	assert.Error(t, p1.Send([]byte("across")), "Connections across a partition should be cut")
+	assert.ErrorIs(t, tr1.Dial("node2"), ErrInjectedFault, "Dialing across a partition should fail")
+
+	f.Heal("split")
+	assert.NoError(t, tr1.Dial("node2"), "Dialing should work after healing")
+}
+
+func TestFaultyTransportPartitionAcceptingSide(t *testing.T) {
+	f := NewFaultInjector(1)
+	network := NewMemoryNetwork()
+
+	handshake := func(addr string) HandshakeFunc {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err, "Generating a key should not error")
+		return NewIdentityHandshake(HandshakeConfig{PrivateKey: priv, ListenAddr: addr})
+	}
+
+	// Only node1 is decorated; node2 dials it as if nothing were wrong
+	accepted := make(chan Peer, 2)
+	mt := NewMemoryTransport(network, TCPTransportOpts{
+		ListenAddr:    "node1",
+		HandshakeFunc: handshake("node1"),
+		Decoder:       DefaultDecoder{},
+	})
+	tr1 := NewFaultyTransport(mt, f)
+	mt.OnPeer = tr1.WrapOnPeer(func(p Peer) error {
+		accepted <- p
+		return nil
+	})
+	mt.OnPeerDisconnect = tr1.WrapOnPeerDisconnect(nil)
+	assert.NoError(t, tr1.ListenAndAccept(), "Listening should not error")
+	t.Cleanup(func() { tr1.Close() })
+
+	dialed := make(chan Peer, 2)
+	tr2 := NewMemoryTransport(network, TCPTransportOpts{
+		ListenAddr:    "node2",
+		HandshakeFunc: handshake("node2"),
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			dialed <- p
+			return nil
+		},
+	})
+	assert.NoError(t, tr2.ListenAndAccept(), "Listening should not error")
+	t.Cleanup(func() { tr2.Close() })
+
+	f.Partition("split", "node1")
+	assert.NoError(t, tr2.Dial("node1"), "Undecorated node should reach the listener")
+	p2 := <-dialed
+
+	select {
+	case <-accepted:
+		t.Fatal("Partitioned node should refuse a peer dialing across the partition")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The connection is gone on the dialing side too
+	assert.Eventually(t, func() bool {
+		return p2.Send([]byte("across")) != nil
+	}, time.Second, 10*time.Millisecond, "Connection across a partition should be closed")
+	assert.Empty(t, tr1.Consume(), "Messages across a partition should not be delivered")
+}
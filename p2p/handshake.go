@@ -1,8 +1,18 @@
 package p2p
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"time"
 )
 
 // ErrInvalidHandshake is returned when the handshake fails
@@ -16,24 +26,252 @@ func NOPHandshakeFunc(Peer) error {
 	return nil
 }
 
-// BasicHandshakeFunc performs a basic handshake with version checking
-func BasicHandshakeFunc(peer Peer) error {
-	// Send handshake message
-	handshakeMsg := []byte("DRIFT-FS-v1.0")
-	if err := peer.Send(handshakeMsg); err != nil {
-		return fmt.Errorf("failed to send handshake: %w", err)
+const (
+	// ProtocolVersion is the peer protocol version spoken by this node
+	ProtocolVersion uint16 = 1
+	// MinProtocolVersion is the oldest peer protocol version accepted
+	MinProtocolVersion uint16 = 1
+
+	handshakeTimeout = 10 * time.Second
+	maxHandshakeSize = 16 * 1024
+
+	// tlsExporterLabel labels the TLS keying material the identity
+	// proofs are bound to
+	tlsExporterLabel = "EXPERIMENTAL drift handshake"
+)
+
+// Capability is a set of optional features a node supports
+type Capability uint32
+
+const (
+	// CapabilityStore means the node accepts replicas from peers
+	CapabilityStore Capability = 1 << iota
+	// CapabilityProvenance means the node verifies signed replicas
+	CapabilityProvenance
+)
+
+// Has reports whether all the given capabilities are set
+func (c Capability) Has(flags Capability) bool {
+	return c&flags == flags
+}
+
+// PeerInfo is the identity a peer proved during the handshake
+type PeerInfo struct {
+	NodeID       string
+	PublicKey    ed25519.PublicKey
+	ListenAddr   string
+	Version      uint16
+	Capabilities Capability
+}
+
+// NodeIDFromKey returns the node ID bound to an identity key, so a peer
+// cannot claim another node's ID without holding its private key
+func NodeIDFromKey(pub ed25519.PublicKey) string {
+	hash := sha256.Sum256(pub)
+	return hex.EncodeToString(hash[:])
+}
+
+// HandshakeConfig describes the local node to the peers it connects to
+type HandshakeConfig struct {
+	PrivateKey   ed25519.PrivateKey
+	ListenAddr   string
+	Capabilities Capability
+}
+
+// handshakeHello announces a node and carries a fresh challenge
+type handshakeHello struct {
+	Version      uint16
+	NodeID       string
+	PublicKey    []byte
+	ListenAddr   string
+	Capabilities Capability
+	Nonce        []byte
+}
+
+// handshakeProof answers the remote challenge
+type handshakeProof struct {
+	Signature []byte
+}
+
+// handshakeTranscript returns what a node signs: its own hello, the
+// challenge sent by the remote side and the channel binding, if any
+func handshakeTranscript(hello []byte, remoteNonce []byte, binding []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("drift-handshake-v1")
+	binary.Write(buf, binary.BigEndian, uint32(len(hello)))
+	buf.Write(hello)
+	buf.Write(remoteNonce)
+	buf.Write(binding)
+	return buf.Bytes()
+}
+
+// channelBinding returns the value the identity proofs exchanged over a
+// connection are bound to. Over TLS it is keying material exported from
+// the session, which differs on each side of a man in the middle, so a
+// proof relayed onto another session does not verify. Plain TCP has no
+// binding: it offers no protection against a man in the middle, who can
+// relay the handshake and then read and change everything sent.
+func channelBinding(peer Peer) ([]byte, error) {
+	cs, ok := tlsState(peer)
+	if !ok {
+		return nil, nil
 	}
+	return cs.ExportKeyingMaterial(tlsExporterLabel, nil, 32)
+}
 
-	// Read response
-	buf := make([]byte, len(handshakeMsg))
-	if _, err := peer.Read(buf); err != nil {
-		return fmt.Errorf("failed to read handshake response: %w", err)
+// writeFrame writes a length-prefixed handshake message
+func writeFrame(w io.Writer, b []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(b))); err != nil {
+		return err
 	}
+	_, err := w.Write(b)
+	return err
+}
 
-	// Verify handshake
-	if string(buf) != string(handshakeMsg) {
-		return ErrInvalidHandshake
+// readFrame reads a length-prefixed handshake message
+func readFrame(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > maxHandshakeSize {
+		return nil, fmt.Errorf("%w: message too large (%d bytes)", ErrInvalidHandshake, n)
 	}
 
-	return nil
-}
\ No newline at end of file
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// exchange sends b while reading the remote message. Both sides write
+// first, so on unbuffered connections the write cannot wait for the read.
+func exchange(peer Peer, b []byte) ([]byte, error) {
+	errch := make(chan error, 1)
+	go func() {
+		errch <- writeFrame(peer, b)
+	}()
+
+	remote, err := readFrame(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return remote, <-errch
+}
+
+// NewIdentityHandshake returns a handshake in which both nodes exchange
+// their node ID, identity key, listen address, protocol version and
+// capabilities, and prove possession of the identity key by signing a
+// challenge from the other side. Over TLS the proofs are bound to the
+// session; over plain TCP nothing stops a man in the middle from relaying
+// them. The verified identity is available from the peer's Info method.
+func NewIdentityHandshake(cfg HandshakeConfig) HandshakeFunc {
+	return func(peer Peer) error {
+		peer.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer peer.SetDeadline(time.Time{})
+
+		pub := cfg.PrivateKey.Public().(ed25519.PublicKey)
+		hello := handshakeHello{
+			Version:      ProtocolVersion,
+			NodeID:       NodeIDFromKey(pub),
+			PublicKey:    pub,
+			ListenAddr:   cfg.ListenAddr,
+			Capabilities: cfg.Capabilities,
+			Nonce:        make([]byte, 32),
+		}
+		if _, err := io.ReadFull(rand.Reader, hello.Nonce); err != nil {
+			return err
+		}
+
+		helloBytes, err := json.Marshal(hello)
+		if err != nil {
+			return err
+		}
+
+		remoteBytes, err := exchange(peer, helloBytes)
+		if err != nil {
+			return fmt.Errorf("failed to exchange hello: %w", err)
+		}
+
+		var remote handshakeHello
+		if err := json.Unmarshal(remoteBytes, &remote); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidHandshake, err)
+		}
+		if remote.Version < MinProtocolVersion {
+			return fmt.Errorf("%w: unsupported protocol version %d", ErrInvalidHandshake, remote.Version)
+		}
+		if len(remote.PublicKey) != ed25519.PublicKeySize || len(remote.Nonce) != len(hello.Nonce) {
+			return fmt.Errorf("%w: malformed hello", ErrInvalidHandshake)
+		}
+		if remote.NodeID != NodeIDFromKey(remote.PublicKey) {
+			return fmt.Errorf("%w: node ID does not match identity key", ErrInvalidHandshake)
+		}
+		if remote.NodeID == hello.NodeID || bytes.Equal(remote.Nonce, hello.Nonce) {
+			return fmt.Errorf("%w: connected to self or reflected challenge", ErrInvalidHandshake)
+		}
+
+		binding, err := channelBinding(peer)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidHandshake, err)
+		}
+
+		proof := handshakeProof{
+			Signature: ed25519.Sign(cfg.PrivateKey, handshakeTranscript(helloBytes, remote.Nonce, binding)),
+		}
+		proofBytes, err := json.Marshal(proof)
+		if err != nil {
+			return err
+		}
+
+		remoteProofBytes, err := exchange(peer, proofBytes)
+		if err != nil {
+			return fmt.Errorf("failed to exchange proof: %w", err)
+		}
+
+		var remoteProof handshakeProof
+		if err := json.Unmarshal(remoteProofBytes, &remoteProof); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidHandshake, err)
+		}
+		if !ed25519.Verify(remote.PublicKey, handshakeTranscript(remoteBytes, hello.Nonce, binding), remoteProof.Signature) {
+			return fmt.Errorf("%w: identity proof does not verify", ErrInvalidHandshake)
+		}
+
+		// Over TLS the certificate must have been issued to the same node
+		if cs, ok := tlsState(peer); ok && len(cs.PeerCertificates) > 0 {
+			if CertNodeID(cs.PeerCertificates[0]) != remote.NodeID {
+				return fmt.Errorf("%w: certificate issued to another node", ErrInvalidHandshake)
+			}
+		}
+
+		info := PeerInfo{
+			NodeID:       remote.NodeID,
+			PublicKey:    remote.PublicKey,
+			ListenAddr:   remote.ListenAddr,
+			Version:      remote.Version,
+			Capabilities: remote.Capabilities,
+		}
+
+		setter, ok := peer.(interface{ setInfo(PeerInfo) })
+		if !ok {
+			return fmt.Errorf("%w: peer cannot record identity", ErrInvalidHandshake)
+		}
+		setter.setInfo(info)
+
+		return nil
+	}
+}
+
+// tlsState returns the TLS connection state of a peer, if it uses TLS
+func tlsState(peer Peer) (tls.ConnectionState, bool) {
+	p, ok := peer.(*TCPPeer)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+
+	conn, ok := p.Conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+
+	return conn.ConnectionState(), true
+}
@@ -0,0 +1,146 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runHandshakes runs both ends of a handshake over an in-memory pipe
+func runHandshakes(a, b HandshakeFunc) (*TCPPeer, *TCPPeer, error, error) {
+	c1, c2 := net.Pipe()
+	pa, pb := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+
+	errch := make(chan error, 1)
+	go func() {
+		err := b(pb)
+		if err != nil {
+			c2.Close()
+		}
+		errch <- err
+	}()
+
+	errA := a(pa)
+	if errA != nil {
+		c1.Close()
+	}
+
+	return pa, pb, errA, <-errch
+}
+
+func TestIdentityHandshake(t *testing.T) {
+	pubA, privA, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+	pubB, privB, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+
+	a := NewIdentityHandshake(HandshakeConfig{PrivateKey: privA, ListenAddr: ":3000", Capabilities: CapabilityStore})
+	b := NewIdentityHandshake(HandshakeConfig{PrivateKey: privB, ListenAddr: ":5000", Capabilities: CapabilityStore | CapabilityProvenance})
+
+	pa, pb, errA, errB := runHandshakes(a, b)
+	assert.NoError(t, errA, "Handshake should succeed on the dialing side")
+	assert.NoError(t, errB, "Handshake should succeed on the accepting side")
+
+	// Each side learns the other's identity
+	assert.Equal(t, NodeIDFromKey(pubB), pa.Info().NodeID, "Dialer should learn the remote node ID")
+	assert.Equal(t, ed25519.PublicKey(pubB), pa.Info().PublicKey, "Dialer should learn the remote key")
+	assert.Equal(t, ":5000", pa.Info().ListenAddr, "Dialer should learn the remote listen address")
+	assert.True(t, pa.Info().Capabilities.Has(CapabilityProvenance), "Dialer should learn remote capabilities")
+	assert.Equal(t, ProtocolVersion, pa.Info().Version, "Dialer should learn the remote version")
+
+	assert.Equal(t, NodeIDFromKey(pubA), pb.Info().NodeID, "Acceptor should learn the remote node ID")
+	assert.Equal(t, ":3000", pb.Info().ListenAddr, "Acceptor should learn the remote listen address")
+	assert.False(t, pb.Info().Capabilities.Has(CapabilityProvenance), "Acceptor should learn remote capabilities")
+
+	assert.Equal(t, NodeIDFromKey(pubA), PeerID(pb), "PeerID should use the proven node ID")
+}
+
+func TestIdentityHandshakeRejectsSelf(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+
+	hs := NewIdentityHandshake(HandshakeConfig{PrivateKey: priv})
+
+	_, _, errA, errB := runHandshakes(hs, hs)
+	assert.ErrorIs(t, errA, ErrInvalidHandshake, "Connecting to self should be rejected")
+	assert.ErrorIs(t, errB, ErrInvalidHandshake, "Connecting to self should be rejected")
+}
+
+func TestIdentityHandshakeRejectsGarbage(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+
+	hs := NewIdentityHandshake(HandshakeConfig{PrivateKey: priv})
+
+	// The remote claims a large message and then sends nothing useful
+	garbage := func(p Peer) error {
+		_, err := p.Write([]byte{0xff, 0xff, 0xff, 0xff})
+		return err
+	}
+
+	_, _, errA, _ := runHandshakes(hs, garbage)
+	assert.ErrorIs(t, errA, ErrInvalidHandshake, "Oversized hello should be rejected")
+}
+
+func TestIdentityHandshakeIsBoundToTLS(t *testing.T) {
+	ca, err := NewClusterCA("test CA")
+	assert.NoError(t, err, "Creating CA should not error")
+
+	pubA, privA, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+	pubB, privB, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+	idA, idB := NodeIDFromKey(pubA), NodeIDFromKey(pubB)
+
+	certificate := func(nodeID string) tls.Certificate {
+		cert, err := ca.NewNodeCertificate(nodeID)
+		assert.NoError(t, err, "Issuing certificate should not error")
+		return cert
+	}
+
+	// A man in the middle holding certificates for both node IDs, say
+	// from a rogue issue, ends one TLS session with each node
+	aConn, mToA := net.Pipe()
+	mToB, bConn := net.Pipe()
+	a := tls.Client(aConn, NewMutualTLSConfig(ca.Pool(), certificate(idA), nil))
+	b := tls.Server(bConn, NewMutualTLSConfig(ca.Pool(), certificate(idB), nil))
+	asB := tls.Server(mToA, NewMutualTLSConfig(ca.Pool(), certificate(idB), nil))
+	asA := tls.Client(mToB, NewMutualTLSConfig(ca.Pool(), certificate(idA), nil))
+	defer func() {
+		for _, c := range []net.Conn{a, b, asB, asA} {
+			c.Close()
+		}
+	}()
+
+	// It relays everything between the sessions
+	go func() {
+		if asB.Handshake() == nil && asA.Handshake() == nil {
+			go io.Copy(asA, asB)
+			io.Copy(asB, asA)
+		}
+	}()
+
+	handshake := func(conn *tls.Conn, outbound bool, priv ed25519.PrivateKey) error {
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+		err := NewIdentityHandshake(HandshakeConfig{PrivateKey: priv})(NewTCPPeer(conn, outbound))
+		if err != nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- handshake(b, false, privB)
+	}()
+
+	assert.ErrorIs(t, handshake(a, true, privA), ErrInvalidHandshake, "Proof relayed from another TLS session should be rejected")
+	assert.Error(t, <-errch, "Proof relayed from another TLS session should be rejected")
+}
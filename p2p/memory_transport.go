@@ -0,0 +1,141 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrConnRefused is returned when dialing an address nobody listens on
+var ErrConnRefused = errors.New("connection refused")
+
+// MemoryNetwork is an in-process network. Transports created on it with
+// NewMemoryTransport listen on and dial each other by name, over
+// synchronous in-memory pipes instead of sockets.
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+	nextConn  int
+}
+
+// NewMemoryNetwork creates an empty in-memory network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		listeners: make(map[string]*memoryListener),
+	}
+}
+
+// MemoryTransport is a TCPTransport whose connections run over a
+// MemoryNetwork. Handshakes, TLS, streams and OnPeer work as over TCP.
+type MemoryTransport struct {
+	*TCPTransport
+}
+
+// NewMemoryTransport creates a transport on the network. Its ListenAddr
+// is the name other transports on the network dial it by.
+func NewMemoryTransport(network *MemoryNetwork, opts TCPTransportOpts) *MemoryTransport {
+	t := NewTCPTransport(opts)
+	t.listen = network.listen
+	t.dial = func(addr string) (net.Conn, error) {
+		return network.dial(opts.ListenAddr, addr)
+	}
+
+	return &MemoryTransport{TCPTransport: t}
+}
+
+func (n *MemoryNetwork) listen(addr string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("listen %s: address already in use", addr)
+	}
+
+	l := &memoryListener{
+		network: n,
+		addr:    memoryAddr(addr),
+		connch:  make(chan net.Conn),
+		closech: make(chan struct{}),
+	}
+	n.listeners[addr] = l
+
+	return l, nil
+}
+
+// dial connects from the transport listening on from to the one on addr
+func (n *MemoryNetwork) dial(from, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	n.nextConn++
+	// Like an ephemeral port, the dialing end gets an address of its own
+	local := memoryAddr(fmt.Sprintf("%s#%d", from, n.nextConn))
+	n.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("dial %s: %w", addr, ErrConnRefused)
+	}
+
+	c1, c2 := net.Pipe()
+	client := &memoryConn{Conn: c1, local: local, remote: l.addr}
+	server := &memoryConn{Conn: c2, local: l.addr, remote: local}
+
+	select {
+	case l.connch <- server:
+		return client, nil
+	case <-l.closech:
+		c1.Close()
+		c2.Close()
+		return nil, fmt.Errorf("dial %s: %w", addr, ErrConnRefused)
+	}
+}
+
+// memoryAddr is the address of an endpoint on a MemoryNetwork
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// memoryConn is one end of an in-memory connection
+type memoryConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return c.local }
+func (c *memoryConn) RemoteAddr() net.Addr { return c.remote }
+
+// memoryListener accepts connections dialed on a MemoryNetwork
+type memoryListener struct {
+	network   *MemoryNetwork
+	addr      memoryAddr
+	connch    chan net.Conn
+	closech   chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connch:
+		return conn, nil
+	case <-l.closech:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closech)
+
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+	})
+
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,52 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	network := NewMemoryNetwork()
+	peers := make(chan Peer, 2)
+	opts := func(addr string) TCPTransportOpts {
+		return TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnPeer: func(p Peer) error {
+				peers <- p
+				return nil
+			},
+		}
+	}
+
+	tr1 := NewMemoryTransport(network, opts("node1"))
+	tr2 := NewMemoryTransport(network, opts("node2"))
+	assert.NoError(t, tr1.ListenAndAccept(), "Listening should not error")
+	assert.NoError(t, tr2.ListenAndAccept(), "Listening should not error")
+	defer tr2.Close()
+
+	assert.Error(t, NewMemoryTransport(network, opts("node1")).ListenAndAccept(), "Listening on a taken address should error")
+	assert.ErrorIs(t, tr1.Dial("nobody"), ErrConnRefused, "Dialing an unknown address should be refused")
+
+	assert.NoError(t, tr2.Dial("node1"), "Dialing should not error")
+	p1, p2 := <-peers, <-peers
+	if p1.LocalAddr().String() != "node1" {
+		p1, p2 = p2, p1
+	}
+	assert.Equal(t, "node1", p2.RemoteAddr().String(), "Dialer should see the listen address")
+	assert.NotEqual(t, "node2", p1.RemoteAddr().String(), "Dialer should connect from its own address")
+
+	assert.NoError(t, p2.Send([]byte("hello")), "Sending should not error")
+	select {
+	case rpc := <-tr1.Consume():
+		assert.Equal(t, []byte("hello"), rpc.Payload, "Message should arrive over the memory network")
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	assert.NoError(t, tr1.Close(), "Closing should not error")
+	assert.ErrorIs(t, tr2.Dial("node1"), ErrConnRefused, "Dialing a closed transport should be refused")
+}
@@ -1,23 +1,123 @@
 package p2p
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Frame types carried in MessageHeader.Type
 const (
 	IncomingMessage = 0x1
-	IncomingStream  = 0x2
+	// Stream frames belong to the logical stream in MessageHeader.StreamID
+	StreamOpen   = 0x2
+	StreamData   = 0x3
+	StreamClose  = 0x4
+	StreamWindow = 0x5
+	StreamReset  = 0x6
+	// IncomingHeartbeat proves the sender is alive on an idle connection
+	IncomingHeartbeat = 0x7
+)
+
+const (
+	// headerSize is the encoded size of a MessageHeader
+	headerSize = 13
+	// MaxMessageSize bounds the payload of a single frame
+	MaxMessageSize = 16 * 1024 * 1024
 )
 
-// Message represents a message sent between peers
+// ErrChecksumMismatch is returned when a frame's payload does not match
+// the checksum in its header
+var ErrChecksumMismatch = errors.New("message checksum mismatch")
+
+// Message represents a message sent between peers. On the wire every
+// message is a frame: the header followed by Length bytes of data.
 type Message struct {
 	Header MessageHeader
 	Data   []byte
 }
 
-// MessageHeader contains metadata about the message
+// MessageHeader contains metadata about the message. It is encoded as
+// the type byte, then the big-endian stream ID, length and CRC-32 of the
+// data. The stream ID is zero for frames outside of a stream.
 type MessageHeader struct {
 	Type     byte
+	StreamID uint32
 	Length   uint32
 	Checksum uint32
 }
 
+// NewMessage creates a message of the given frame type, filling in the
+// length and checksum of the data
+func NewMessage(typ byte, data []byte) *Message {
+	return NewStreamMessage(typ, 0, data)
+}
+
+// NewStreamMessage creates a frame belonging to a logical stream
+func NewStreamMessage(typ byte, streamID uint32, data []byte) *Message {
+	return &Message{
+		Header: MessageHeader{
+			Type:     typ,
+			StreamID: streamID,
+			Length:   uint32(len(data)),
+			Checksum: crc32.ChecksumIEEE(data),
+		},
+		Data: data,
+	}
+}
+
+// WriteMessage writes a message as a single frame. The frame is written
+// with one call so frames from concurrent writers do not interleave.
+func WriteMessage(w io.Writer, msg *Message) error {
+	if len(msg.Data) > MaxMessageSize {
+		return fmt.Errorf("message too large: %d bytes", len(msg.Data))
+	}
+
+	buf := make([]byte, headerSize+len(msg.Data))
+	buf[0] = msg.Header.Type
+	binary.BigEndian.PutUint32(buf[1:5], msg.Header.StreamID)
+	binary.BigEndian.PutUint32(buf[5:9], msg.Header.Length)
+	binary.BigEndian.PutUint32(buf[9:13], msg.Header.Checksum)
+	copy(buf[headerSize:], msg.Data)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadMessage reads a single frame and verifies its checksum
+func ReadMessage(r io.Reader) (*Message, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		Header: MessageHeader{
+			Type:     hdr[0],
+			StreamID: binary.BigEndian.Uint32(hdr[1:5]),
+			Length:   binary.BigEndian.Uint32(hdr[5:9]),
+			Checksum: binary.BigEndian.Uint32(hdr[9:13]),
+		},
+	}
+
+	if msg.Header.Length > MaxMessageSize {
+		return nil, fmt.Errorf("message too large: %d bytes", msg.Header.Length)
+	}
+
+	msg.Data = make([]byte, msg.Header.Length)
+	if _, err := io.ReadFull(r, msg.Data); err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(msg.Data) != msg.Header.Checksum {
+		return nil, ErrChecksumMismatch
+	}
+
+	return msg, nil
+}
+
 // MessageType represents different types of messages
 type MessageType byte
 
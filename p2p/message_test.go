@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	large := make([]byte, 64*1024)
+	rand.Read(large)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteMessage(&buf, NewMessage(IncomingMessage, large)), "Writing a large message should not error")
+	assert.NoError(t, WriteMessage(&buf, NewMessage(IncomingMessage, []byte("second"))), "Writing a message should not error")
+
+	// Two messages written back to back are read separately and whole
+	msg, err := ReadMessage(&buf)
+	assert.NoError(t, err, "Reading should not error")
+	assert.Equal(t, byte(IncomingMessage), msg.Header.Type, "Type should round trip")
+	assert.Equal(t, uint32(len(large)), msg.Header.Length, "Length should match the data")
+	assert.Equal(t, large, msg.Data, "Large message should not be truncated")
+
+	msg, err = ReadMessage(&buf)
+	assert.NoError(t, err, "Reading should not error")
+	assert.Equal(t, []byte("second"), msg.Data, "Second message should not be merged into the first")
+}
+
+func TestMessageChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteMessage(&buf, NewMessage(IncomingMessage, []byte("payload"))), "Writing should not error")
+
+	b := buf.Bytes()
+	b[len(b)-1] ^= 0xff
+
+	_, err := ReadMessage(bytes.NewReader(b))
+	assert.ErrorIs(t, err, ErrChecksumMismatch, "Corrupted data should fail the checksum")
+
+	// A truncated frame is an error rather than a short message
+	_, err = ReadMessage(bytes.NewReader(b[:len(b)-2]))
+	assert.Error(t, err, "Truncated frame should error")
+}
+
+func TestDefaultEncoderDecoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := DefaultEncoder{}
+	dec := DefaultDecoder{}
+
+	assert.NoError(t, enc.Encode(&buf, &RPC{Payload: []byte("hello")}), "Encoding a message should not error")
+	assert.NoError(t, enc.Encode(&buf, &RPC{Type: StreamClose, StreamID: 7}), "Encoding a stream frame should not error")
+	assert.Error(t, enc.Encode(&buf, &RPC{}), "Encoding an empty payload should error")
+
+	var rpc RPC
+	assert.NoError(t, dec.Decode(&buf, &rpc), "Decoding a message should not error")
+	assert.Equal(t, []byte("hello"), rpc.Payload, "Payload should round trip")
+	assert.Equal(t, byte(IncomingMessage), rpc.Type, "Message should not be a stream frame")
+
+	rpc = RPC{}
+	assert.NoError(t, dec.Decode(&buf, &rpc), "Decoding a stream frame should not error")
+	assert.Equal(t, byte(StreamClose), rpc.Type, "Frame type should round trip")
+	assert.Equal(t, uint32(7), rpc.StreamID, "Stream ID should round trip")
+}
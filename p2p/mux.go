@@ -0,0 +1,511 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every connection carries any number of logical streams next to plain
+// messages. Either side can open a stream: the dialing side uses odd
+// stream IDs and the accepting side even ones, so IDs never collide.
+// Each stream has a receive window limiting how many bytes the sender
+// may have in flight. The receiver grants more with StreamWindow frames
+// as its application reads, so the read loop never blocks on a stream
+// and one slow transfer cannot hold up messages or other streams.
+
+const (
+	// streamWindow is the receive window of every stream
+	streamWindow = 256 * 1024
+	// maxStreamFrame bounds the data carried by one StreamData frame
+	maxStreamFrame = 32 * 1024
+	// maxPendingStreams bounds the streams the remote side may have open
+	// that the application has not accepted yet; further opens are reset
+	maxPendingStreams = 64
+)
+
+// acceptTimeout is how long a stream opened by the remote side waits to
+// be accepted before it is reset
+var acceptTimeout = 30 * time.Second
+
+var (
+	// ErrStreamReset is returned by streams aborted by either side
+	ErrStreamReset = errors.New("stream reset")
+	// ErrStreamClosed is returned when writing to a closed stream
+	ErrStreamClosed = errors.New("stream closed")
+	// ErrConnClosed is returned by streams whose connection went away
+	ErrConnClosed = errors.New("peer connection closed")
+)
+
+// isStreamFrame reports whether a frame type belongs to a stream
+func isStreamFrame(typ byte) bool {
+	return typ >= StreamOpen && typ <= StreamReset
+}
+
+// session multiplexes the streams of one connection
+type session struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+}
+
+func newSession(conn net.Conn, outbound bool) *session {
+	s := &session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+	}
+	if outbound {
+		s.nextID = 1
+	}
+	return s
+}
+
+// writeFrame writes one frame, serialising writers on the connection
+func (s *session) writeFrame(typ byte, id uint32, data []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	return WriteMessage(s.conn, NewStreamMessage(typ, id, data))
+}
+
+// openStream allocates a stream and announces it to the remote side
+func (s *session) openStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	st := newStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.nextID += 2
+	s.mu.Unlock()
+
+	if err := s.writeFrame(StreamOpen, st.id, nil); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// acceptStream returns a stream opened by the remote side
+func (s *session) acceptStream(id uint32) (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	st, ok := s.streams[id]
+	if !ok || id%2 == s.nextID%2 || st.accepted {
+		return nil, fmt.Errorf("stream %d is not open", id)
+	}
+	st.accepted = true
+	st.acceptTimer.Stop()
+
+	return st, nil
+}
+
+// pending returns how many streams the remote side opened that were not
+// accepted yet; s.mu must be held
+func (s *session) pending() int {
+	n := 0
+	for id, st := range s.streams {
+		if id%2 != s.nextID%2 && !st.accepted {
+			n++
+		}
+	}
+	return n
+}
+
+// expire resets a stream the remote side opened if it still was not
+// accepted
+func (s *session) expire(st *Stream) {
+	s.mu.Lock()
+	expired := s.streams[st.id] == st && !st.accepted
+	s.mu.Unlock()
+
+	if expired {
+		st.Reset()
+	}
+}
+
+func (s *session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.streams[id]
+}
+
+func (s *session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, id)
+}
+
+// handleFrame applies a stream frame read from the connection. An error
+// means the remote side broke the protocol and the connection must go.
+func (s *session) handleFrame(typ byte, id uint32, data []byte) error {
+	if typ == StreamOpen {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.err != nil {
+			return nil
+		}
+		if id == 0 || id%2 == s.nextID%2 {
+			return fmt.Errorf("remote opened stream %d with a local ID", id)
+		}
+		if _, ok := s.streams[id]; ok {
+			return fmt.Errorf("stream %d opened twice", id)
+		}
+		// Refuse the stream rather than buffer for an unbounded backlog;
+		// the reset is written off the read loop
+		if s.pending() >= maxPendingStreams {
+			go s.writeFrame(StreamReset, id, nil)
+			return nil
+		}
+
+		st := newStream(s, id)
+		st.acceptTimer = time.AfterFunc(acceptTimeout, func() { s.expire(st) })
+		s.streams[id] = st
+		return nil
+	}
+
+	// Frames may still arrive for streams this side already reset
+	st := s.stream(id)
+	if st == nil {
+		return nil
+	}
+
+	switch typ {
+	case StreamData:
+		return st.receive(data)
+	case StreamClose:
+		st.remoteClose()
+	case StreamWindow:
+		if len(data) != 4 {
+			return fmt.Errorf("malformed window update for stream %d", id)
+		}
+		st.grant(binary.BigEndian.Uint32(data))
+	case StreamReset:
+		st.fail(ErrStreamReset)
+		s.remove(id)
+	}
+
+	return nil
+}
+
+// close fails every stream once the connection is gone
+func (s *session) close() {
+	s.mu.Lock()
+	s.err = ErrConnClosed
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mu.Unlock()
+
+	for _, st := range streams {
+		if st.acceptTimer != nil {
+			st.acceptTimer.Stop()
+		}
+		st.fail(ErrConnClosed)
+	}
+}
+
+// Stream is a flow-controlled, bidirectional byte stream multiplexed
+// over a peer connection
+type Stream struct {
+	id      uint32
+	session *session
+	// accepted is set, under the session lock, once the application
+	// accepted a stream the remote side opened; acceptTimer resets it
+	// if that takes too long
+	accepted    bool
+	acceptTimer *time.Timer
+
+	mu sync.Mutex
+	// changed is closed and replaced whenever the stream state changes
+	changed chan struct{}
+	buf     bytes.Buffer
+	// recvWindow is how many more bytes the remote side may send, and
+	// unacked how many were read since the window was last extended
+	recvWindow uint32
+	unacked    uint32
+	sendWindow uint32
+	// readClosed is set when the remote side closed, writeClosed when
+	// this side did. The stream is dropped once both are set.
+	readClosed  bool
+	writeClosed bool
+	err         error
+	// readDeadline and writeDeadline fail reads and writes once passed
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+// deadline is a point in time after which a stream operation fails. A
+// timer wakes up the operations waiting when it passes.
+type deadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+// set moves the deadline, the zero time meaning none; st.mu must be held
+func (d *deadline) set(st *Stream, t time.Time) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	d.t = t
+	if !t.IsZero() {
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			st.mu.Lock()
+			st.signal()
+			st.mu.Unlock()
+		})
+	}
+}
+
+// exceeded reports whether the deadline passed
+func (d *deadline) exceeded() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
+
+func newStream(s *session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		changed:    make(chan struct{}),
+		recvWindow: streamWindow,
+		sendWindow: streamWindow,
+	}
+}
+
+// ID returns the stream ID, which the remote side passes to AcceptStream
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// SetDeadline sets the read and write deadlines, like net.Conn. Reads and
+// writes past a deadline, including ones already waiting, fail with
+// os.ErrDeadlineExceeded. The zero time means no deadline.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.readDeadline.set(st, t)
+	st.writeDeadline.set(st, t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for reads
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.readDeadline.set(st, t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writes
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.writeDeadline.set(st, t)
+	return nil
+}
+
+// signal wakes up readers and writers; st.mu must be held
+func (st *Stream) signal() {
+	close(st.changed)
+	st.changed = make(chan struct{})
+}
+
+// wait releases st.mu until the stream state changes
+func (st *Stream) wait() {
+	ch := st.changed
+	st.mu.Unlock()
+	<-ch
+	st.mu.Lock()
+}
+
+// Read reads stream data, returning io.EOF once the remote side closed
+// the stream and all its data was read
+func (st *Stream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+	for st.buf.Len() == 0 || st.readDeadline.exceeded() {
+		if st.err != nil {
+			st.mu.Unlock()
+			return 0, st.err
+		}
+		if st.readDeadline.exceeded() {
+			st.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		if st.readClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		st.wait()
+	}
+
+	n, _ := st.buf.Read(b)
+	st.unacked += uint32(n)
+
+	var grant uint32
+	if st.unacked >= streamWindow/2 && !st.readClosed {
+		grant = st.unacked
+		st.recvWindow += grant
+		st.unacked = 0
+	}
+	st.mu.Unlock()
+
+	if grant > 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], grant)
+		st.session.writeFrame(StreamWindow, st.id, b[:])
+	}
+
+	return n, nil
+}
+
+// Write writes data to the stream, blocking while the remote receive
+// window is full
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.writeClosed && !st.writeDeadline.exceeded() {
+			st.wait()
+		}
+		if st.err != nil {
+			st.mu.Unlock()
+			return written, st.err
+		}
+		if st.writeClosed {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.writeDeadline.exceeded() {
+			st.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+
+		n := min(len(b), int(st.sendWindow), maxStreamFrame)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(StreamData, st.id, b[:n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// Close closes the stream for writing. The remote side reads io.EOF
+// after the data written so far, and this side can keep reading until
+// the remote side closes as well.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.writeClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	done := st.readClosed
+	st.signal()
+	st.mu.Unlock()
+
+	if done {
+		st.session.remove(st.id)
+	}
+
+	return st.session.writeFrame(StreamClose, st.id, nil)
+}
+
+// Reset aborts the stream in both directions, discarding unread data.
+// It is a no-op on streams that are already closed on both sides.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.err != nil || (st.readClosed && st.writeClosed) {
+		st.mu.Unlock()
+		return nil
+	}
+	st.err = ErrStreamReset
+	st.buf.Reset()
+	st.signal()
+	st.mu.Unlock()
+
+	st.session.remove(st.id)
+
+	return st.session.writeFrame(StreamReset, st.id, nil)
+}
+
+// receive buffers data sent by the remote side
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if uint32(len(data)) > st.recvWindow {
+		return fmt.Errorf("stream %d exceeded its receive window", st.id)
+	}
+	st.recvWindow -= uint32(len(data))
+
+	if st.err == nil {
+		st.buf.Write(data)
+		st.signal()
+	}
+
+	return nil
+}
+
+// remoteClose records that the remote side finished writing
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.readClosed = true
+	done := st.writeClosed
+	st.signal()
+	st.mu.Unlock()
+
+	if done {
+		st.session.remove(st.id)
+	}
+}
+
+// grant extends the send window
+func (st *Stream) grant(n uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.sendWindow += n
+	st.signal()
+}
+
+// fail aborts pending and future reads and writes with err
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.err == nil {
+		st.err = err
+		st.signal()
+	}
+}
@@ -0,0 +1,244 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pipePeers returns two connected peers whose read loops run until the
+// test ends, with plain messages delivered to the returned channels
+func pipePeers(t *testing.T) (*TCPPeer, *TCPPeer, chan []byte, chan []byte) {
+	c1, c2 := net.Pipe()
+	p1 := NewTCPPeer(c1, true)
+	p2 := NewTCPPeer(c2, false)
+	msgs1 := make(chan []byte, 16)
+	msgs2 := make(chan []byte, 16)
+
+	readLoop := func(p *TCPPeer, msgs chan []byte) {
+		defer p.session.close()
+		for {
+			var rpc RPC
+			if err := (DefaultDecoder{}).Decode(p.Conn, &rpc); err != nil {
+				return
+			}
+			if isStreamFrame(rpc.Type) {
+				if err := p.session.handleFrame(rpc.Type, rpc.StreamID, rpc.Payload); err != nil {
+					return
+				}
+				continue
+			}
+			msgs <- rpc.Payload
+		}
+	}
+	go readLoop(p1, msgs1)
+	go readLoop(p2, msgs2)
+
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	return p1, p2, msgs1, msgs2
+}
+
+func TestStreamConcurrentTransfers(t *testing.T) {
+	p1, p2, _, msgs2 := pipePeers(t)
+
+	// Several transfers larger than the window, plus messages in between
+	payloads := make([][]byte, 4)
+	streams := make([]*Stream, len(payloads))
+	for i := range payloads {
+		payloads[i] = make([]byte, 3*streamWindow+i)
+		rand.Read(payloads[i])
+
+		stream, err := p1.OpenStream()
+		assert.NoError(t, err, "Opening a stream should not error")
+		streams[i] = stream
+	}
+
+	var wg sync.WaitGroup
+	for i, stream := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := stream.Write(payloads[i])
+			assert.NoError(t, err, "Writing to a stream should not error")
+			assert.NoError(t, stream.Close(), "Closing a stream should not error")
+		}()
+	}
+
+	assert.NoError(t, p1.Send([]byte("control")), "Sending a message mid-transfer should not error")
+	assert.Equal(t, []byte("control"), <-msgs2, "Message should arrive while streams are in flight")
+
+	// Read the streams in reverse order; flow control keeps the others
+	// from blocking the connection
+	for i := len(streams) - 1; i >= 0; i-- {
+		stream, err := p2.AcceptStream(streams[i].ID())
+		assert.NoError(t, err, "Accepting a stream should not error")
+
+		got, err := io.ReadAll(stream)
+		assert.NoError(t, err, "Reading a stream should not error")
+		assert.True(t, bytes.Equal(payloads[i], got), "Stream %d should carry its own data", i)
+		assert.NoError(t, stream.Close(), "Closing the accepting side should not error")
+	}
+
+	wg.Wait()
+}
+
+func TestStreamBidirectional(t *testing.T) {
+	p1, p2, _, msgs2 := pipePeers(t)
+
+	// Both sides open streams at once without their IDs colliding
+	s1, err := p1.OpenStream()
+	assert.NoError(t, err, "Opening a stream should not error")
+	s2, err := p2.OpenStream()
+	assert.NoError(t, err, "Opening a stream should not error")
+	assert.NotEqual(t, s1.ID()%2, s2.ID()%2, "Dialer and acceptor should use separate IDs")
+
+	// Like a request naming the stream, a message follows the open frame
+	assert.NoError(t, p1.Send([]byte("request")), "Sending a message should not error")
+	<-msgs2
+
+	remote, err := p2.AcceptStream(s1.ID())
+	assert.NoError(t, err, "Accepting a stream should not error")
+
+	go func() {
+		remote.Write([]byte("response"))
+		remote.Close()
+	}()
+
+	got, err := io.ReadAll(s1)
+	assert.NoError(t, err, "Reading the response should not error")
+	assert.Equal(t, []byte("response"), got, "Opener should read what the acceptor wrote")
+
+	_, err = p2.AcceptStream(s2.ID())
+	assert.Error(t, err, "A side should not accept its own stream")
+}
+
+func TestStreamReset(t *testing.T) {
+	p1, p2, _, msgs2 := pipePeers(t)
+
+	stream, err := p1.OpenStream()
+	assert.NoError(t, err, "Opening a stream should not error")
+	assert.NoError(t, p1.Send([]byte("request")), "Sending a message should not error")
+	<-msgs2
+
+	remote, err := p2.AcceptStream(stream.ID())
+	assert.NoError(t, err, "Accepting a stream should not error")
+
+	// A writer blocked on a full window is released by the reset
+	errch := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, 2*streamWindow))
+		errch <- err
+	}()
+
+	assert.NoError(t, remote.Reset(), "Resetting a stream should not error")
+	assert.ErrorIs(t, <-errch, ErrStreamReset, "Writer should see the reset")
+
+	_, err = remote.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrStreamReset, "Reads after a reset should fail")
+}
+
+func TestStreamConnClosed(t *testing.T) {
+	p1, p2, _, _ := pipePeers(t)
+
+	stream, err := p1.OpenStream()
+	assert.NoError(t, err, "Opening a stream should not error")
+
+	errch := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		errch <- err
+	}()
+
+	p2.Close()
+	assert.ErrorIs(t, <-errch, ErrConnClosed, "Pending reads should fail when the connection goes")
+}
+
+func TestStreamDeadline(t *testing.T) {
+	p1, p2, _, msgs2 := pipePeers(t)
+
+	stream, err := p1.OpenStream()
+	assert.NoError(t, err, "Opening a stream should not error")
+	assert.NoError(t, p1.Send([]byte("request")), "Sending a message should not error")
+	<-msgs2
+
+	remote, err := p2.AcceptStream(stream.ID())
+	assert.NoError(t, err, "Accepting a stream should not error")
+
+	// A read waiting for data that never comes is released by the deadline
+	assert.NoError(t, stream.SetReadDeadline(time.Now().Add(20*time.Millisecond)), "Setting a deadline should not error")
+	_, err = stream.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded, "Read should fail past its deadline")
+
+	// So is a write blocked on a full window
+	assert.NoError(t, stream.SetWriteDeadline(time.Now().Add(20*time.Millisecond)), "Setting a deadline should not error")
+	n, err := stream.Write(make([]byte, 2*streamWindow))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded, "Write should fail past its deadline")
+	assert.Equal(t, streamWindow, n, "Write should send what the window allowed")
+
+	// Clearing the deadline makes the stream usable again
+	assert.NoError(t, stream.SetDeadline(time.Time{}), "Clearing the deadline should not error")
+	go remote.Write([]byte("late"))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(stream, b)
+	assert.NoError(t, err, "Read should succeed without a deadline")
+	assert.Equal(t, []byte("late"), b, "Read should return the data sent")
+}
+
+func TestStreamAcceptBacklog(t *testing.T) {
+	p1, p2, _, msgs2 := pipePeers(t)
+
+	streams := make([]*Stream, maxPendingStreams+1)
+	for i := range streams {
+		var err error
+		streams[i], err = p1.OpenStream()
+		assert.NoError(t, err, "Opening a stream should not error")
+	}
+	assert.NoError(t, p1.Send([]byte("request")), "Sending a message should not error")
+	<-msgs2
+
+	// The stream past the backlog is refused
+	refused := streams[maxPendingStreams]
+	assert.NoError(t, refused.SetReadDeadline(time.Now().Add(time.Second)), "Setting a deadline should not error")
+	_, err := refused.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrStreamReset, "Stream past the backlog should be reset")
+	_, err = p2.AcceptStream(refused.ID())
+	assert.Error(t, err, "Refused stream should not be accepted")
+
+	// Accepting a stream makes room for another
+	_, err = p2.AcceptStream(streams[0].ID())
+	assert.NoError(t, err, "Accepting a stream should not error")
+	next, err := p1.OpenStream()
+	assert.NoError(t, err, "Opening a stream should not error")
+	assert.NoError(t, p1.Send([]byte("request")), "Sending a message should not error")
+	<-msgs2
+	_, err = p2.AcceptStream(next.ID())
+	assert.NoError(t, err, "Stream within the backlog should be accepted")
+}
+
+func TestStreamAcceptTimeout(t *testing.T) {
+	timeout := acceptTimeout
+	acceptTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { acceptTimeout = timeout })
+
+	p1, p2, _, _ := pipePeers(t)
+
+	stream, err := p1.OpenStream()
+	assert.NoError(t, err, "Opening a stream should not error")
+	assert.NoError(t, stream.SetReadDeadline(time.Now().Add(time.Second)), "Setting a deadline should not error")
+
+	_, err = stream.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrStreamReset, "Stream not accepted in time should be reset")
+	_, err = p2.AcceptStream(stream.ID())
+	assert.Error(t, err, "Expired stream should not be accepted")
+}
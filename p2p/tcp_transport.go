@@ -1,11 +1,22 @@
 package p2p
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
-	"sync"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a peer may take to complete TLS
+const tlsHandshakeTimeout = 10 * time.Second
+
+const (
+	// DefaultHeartbeatInterval is how often connections send heartbeats
+	DefaultHeartbeatInterval = 5 * time.Second
+	// DefaultHeartbeatTimeout is how long a silent peer is kept
+	DefaultHeartbeatTimeout = 15 * time.Second
 )
 
 // TCPPeer represents the remote node over a TCP established connection
@@ -15,24 +26,45 @@ type TCPPeer struct {
 	// if we dial and retrieve a conn => outbound == true
 	// if we accept and retrieve a conn => outbound == false
 	outbound bool
-	wg       *sync.WaitGroup
+	info     PeerInfo
+	session  *session
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		session:  newSession(conn, outbound),
 	}
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// Info implements the Peer interface
+func (p *TCPPeer) Info() PeerInfo {
+	return p.info
 }
 
+// Outbound implements the Peer interface
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+func (p *TCPPeer) setInfo(info PeerInfo) {
+	p.info = info
+}
+
+// Send implements the Peer interface, writing b as a single message frame
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
-	return err
+	return p.session.writeFrame(IncomingMessage, 0, b)
+}
+
+// OpenStream implements the Peer interface
+func (p *TCPPeer) OpenStream() (*Stream, error) {
+	return p.session.openStream()
+}
+
+// AcceptStream implements the Peer interface
+func (p *TCPPeer) AcceptStream(id uint32) (*Stream, error) {
+	return p.session.acceptStream(id)
 }
 
 type TCPTransportOpts struct {
@@ -40,18 +72,41 @@ type TCPTransportOpts struct {
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// TLSConfig, when set, runs every connection over TLS. Use
+	// NewMutualTLSConfig for mutually authenticated, pinned peers.
+	TLSConfig *tls.Config
+	// OnPeerDisconnect is called with the reason once the connection to
+	// a peer accepted by OnPeer is gone
+	OnPeerDisconnect func(Peer, error)
+	// HeartbeatInterval is how often a heartbeat is sent to every peer,
+	// and HeartbeatTimeout how long a peer may send nothing at all before
+	// it is considered dead and dropped. Zero uses the defaults and a
+	// negative value turns either off.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
 }
 
 type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener
 	rpcch    chan RPC
+
+	// listen and dial open raw connections, over TCP unless the
+	// transport runs on a MemoryNetwork
+	listen func(addr string) (net.Listener, error)
+	dial   func(addr string) (net.Conn, error)
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC, 1024),
+		listen: func(addr string) (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		},
+		dial: func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		},
 	}
 }
 
@@ -74,11 +129,15 @@ func (t *TCPTransport) Close() error {
 
 // Dial implements the Transport interface
 func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	conn, err := t.dial(addr)
 	if err != nil {
 		return err
 	}
 
+	if t.TLSConfig != nil {
+		conn = tls.Client(conn, t.TLSConfig)
+	}
+
 	go t.handleConn(conn, true)
 
 	return nil
@@ -87,11 +146,15 @@ func (t *TCPTransport) Dial(addr string) error {
 func (t *TCPTransport) ListenAndAccept() error {
 	var err error
 
-	t.listener, err = net.Listen("tcp", t.ListenAddr)
+	t.listener, err = t.listen(t.ListenAddr)
 	if err != nil {
 		return err
 	}
 
+	if t.TLSConfig != nil {
+		t.listener = tls.NewListener(t.listener, t.TLSConfig)
+	}
+
 	go t.startAcceptLoop()
 
 	log.Printf("TCP transport listening on port: %s\n", t.ListenAddr)
@@ -125,7 +188,18 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		conn.Close()
 	}()
 
+	// Complete the TLS handshake up front so a rejected peer never
+	// reaches the handshake func or OnPeer
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err = tlsConn.Handshake(); err != nil {
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+
 	peer := NewTCPPeer(conn, outbound)
+	defer peer.session.close()
 
 	if err = t.HandshakeFunc(peer); err != nil {
 		return
@@ -137,24 +211,75 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		}
 	}
 
+	if t.OnPeerDisconnect != nil {
+		defer func() {
+			// Fail pending streams before telling the owner
+			conn.Close()
+			peer.session.close()
+			t.OnPeerDisconnect(peer, err)
+		}()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go t.sendHeartbeats(peer, done)
+
+	timeout := t.HeartbeatTimeout
+	if timeout == 0 {
+		timeout = DefaultHeartbeatTimeout
+	}
+
 	// Read loop
 	for {
+		if timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+
 		rpc := RPC{}
 		err = t.Decoder.Decode(conn, &rpc)
 		if err != nil {
 			return
 		}
 
-		rpc.From = conn.RemoteAddr().String()
+		if rpc.Type == IncomingHeartbeat {
+			continue
+		}
 
-		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
+		if isStreamFrame(rpc.Type) {
+			if err = peer.session.handleFrame(rpc.Type, rpc.StreamID, rpc.Payload); err != nil {
+				return
+			}
 			continue
 		}
 
+		rpc.From = PeerID(peer)
+
 		t.rpcch <- rpc
 	}
 }
+
+// sendHeartbeats keeps the peer's read deadline from expiring while the
+// connection is otherwise idle
+func (t *TCPTransport) sendHeartbeats(peer *TCPPeer, done chan struct{}) {
+	interval := t.HeartbeatInterval
+	if interval == 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	if interval < 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := peer.session.writeFrame(IncomingHeartbeat, 0, nil); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,3 +20,73 @@ func TestTCPTransport(t *testing.T) {
 	assert.Equal(t, listenAddr, tr.Addr(), "Transport address should match")
 	assert.NotNil(t, tr.rpcch, "RPC channel should be initialized")
 }
+
+// heartbeatPair connects node1 to node2 over memory transports with the
+// given heartbeat settings, returning the disconnects each side reports
+func heartbeatPair(t *testing.T, opts1, opts2 TCPTransportOpts) (chan error, chan error) {
+	network := NewMemoryNetwork()
+	newTransport := func(addr string, opts TCPTransportOpts) (*MemoryTransport, chan error) {
+		disconnects := make(chan error, 1)
+		opts.ListenAddr = addr
+		opts.HandshakeFunc = NOPHandshakeFunc
+		opts.Decoder = DefaultDecoder{}
+		opts.OnPeerDisconnect = func(p Peer, err error) {
+			disconnects <- err
+		}
+
+		tr := NewMemoryTransport(network, opts)
+		assert.NoError(t, tr.ListenAndAccept(), "Listening should not error")
+		t.Cleanup(func() { tr.Close() })
+		return tr, disconnects
+	}
+
+	tr1, d1 := newTransport("node1", opts1)
+	_, d2 := newTransport("node2", opts2)
+	assert.NoError(t, tr1.Dial("node2"), "Dialing should not error")
+
+	return d1, d2
+}
+
+func TestHeartbeatKeepsIdlePeer(t *testing.T) {
+	opts := TCPTransportOpts{
+		HeartbeatInterval: 20 * time.Millisecond,
+		HeartbeatTimeout:  100 * time.Millisecond,
+	}
+	d1, d2 := heartbeatPair(t, opts, opts)
+
+	select {
+	case err := <-d1:
+		t.Fatalf("idle peer was dropped: %v", err)
+	case err := <-d2:
+		t.Fatalf("idle peer was dropped: %v", err)
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	// node1 goes silent, so node2 has to drop it after the timeout
+	silent := TCPTransportOpts{
+		HeartbeatInterval: -1,
+		HeartbeatTimeout:  -1,
+	}
+	watchful := TCPTransportOpts{
+		HeartbeatInterval: -1,
+		HeartbeatTimeout:  100 * time.Millisecond,
+	}
+	d1, d2 := heartbeatPair(t, silent, watchful)
+
+	select {
+	case err := <-d2:
+		var netErr net.Error
+		assert.ErrorAs(t, err, &netErr, "Disconnect should report the timeout")
+		assert.True(t, netErr.Timeout(), "Disconnect should be a timeout")
+	case <-time.After(time.Second):
+		t.Fatal("silent peer was not dropped")
+	}
+
+	select {
+	case <-d1:
+	case <-time.After(time.Second):
+		t.Fatal("silent peer did not notice the disconnect")
+	}
+}
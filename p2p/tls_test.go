@@ -0,0 +1,118 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tlsHandshake runs a client and server handshake over an in-memory pipe
+func tlsHandshake(client, server *tls.Config) (clientErr, serverErr error) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- tls.Server(s, server).Handshake()
+		s.Close()
+	}()
+
+	clientErr = tls.Client(c, client).Handshake()
+	c.Close()
+
+	return clientErr, <-errch
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, err := NewClusterCA("test CA")
+	assert.NoError(t, err, "Creating CA should not error")
+
+	certA, err := ca.NewNodeCertificate("node-a", "127.0.0.1")
+	assert.NoError(t, err, "Issuing certificate should not error")
+	certB, err := ca.NewNodeCertificate("node-b")
+	assert.NoError(t, err, "Issuing certificate should not error")
+
+	assert.Equal(t, "node-a", CertNodeID(certA.Leaf), "Certificate should carry the node ID")
+
+	// Same CA, no pins
+	cfgA := NewMutualTLSConfig(ca.Pool(), certA, nil)
+	cfgB := NewMutualTLSConfig(ca.Pool(), certB, nil)
+	clientErr, serverErr := tlsHandshake(cfgA, cfgB)
+	assert.NoError(t, clientErr, "Client handshake should succeed")
+	assert.NoError(t, serverErr, "Server handshake should succeed")
+
+	// A node from another cluster is rejected
+	other, err := NewClusterCA("other CA")
+	assert.NoError(t, err, "Creating CA should not error")
+	certX, err := other.NewNodeCertificate("node-x")
+	assert.NoError(t, err, "Issuing certificate should not error")
+
+	_, serverErr = tlsHandshake(NewMutualTLSConfig(ca.Pool(), certX, nil), cfgB)
+	assert.Error(t, serverErr, "Server should reject a certificate from another CA")
+}
+
+func TestMutualTLSPinning(t *testing.T) {
+	ca, err := NewClusterCA("test CA")
+	assert.NoError(t, err, "Creating CA should not error")
+
+	certA, err := ca.NewNodeCertificate("node-a")
+	assert.NoError(t, err, "Issuing certificate should not error")
+	certB, err := ca.NewNodeCertificate("node-b")
+	assert.NoError(t, err, "Issuing certificate should not error")
+
+	pins := map[string][]byte{
+		"node-a": CertFingerprint(certA.Leaf),
+		"node-b": CertFingerprint(certB.Leaf),
+	}
+
+	clientErr, serverErr := tlsHandshake(NewMutualTLSConfig(ca.Pool(), certA, pins), NewMutualTLSConfig(ca.Pool(), certB, pins))
+	assert.NoError(t, clientErr, "Pinned client handshake should succeed")
+	assert.NoError(t, serverErr, "Pinned server handshake should succeed")
+
+	// A second certificate for node-a, validly signed but not pinned
+	rogue, err := ca.NewNodeCertificate("node-a")
+	assert.NoError(t, err, "Issuing certificate should not error")
+
+	_, serverErr = tlsHandshake(NewMutualTLSConfig(ca.Pool(), rogue, pins), NewMutualTLSConfig(ca.Pool(), certB, pins))
+	assert.ErrorIs(t, serverErr, ErrPeerNotPinned, "Server should reject an unpinned certificate")
+}
+
+func TestTCPTransportTLS(t *testing.T) {
+	ca, err := NewClusterCA("test CA")
+	assert.NoError(t, err, "Creating CA should not error")
+
+	peers := make(chan Peer, 2)
+	newTransport := func(nodeID string) *TCPTransport {
+		cert, err := ca.NewNodeCertificate(nodeID)
+		assert.NoError(t, err, "Issuing certificate should not error")
+
+		return NewTCPTransport(TCPTransportOpts{
+			ListenAddr:    "127.0.0.1:0",
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnPeer:        func(p Peer) error { peers <- p; return nil },
+			TLSConfig:     NewMutualTLSConfig(ca.Pool(), cert, nil),
+		})
+	}
+
+	server := newTransport("server")
+	assert.NoError(t, server.ListenAndAccept(), "Listening should not error")
+	defer server.Close()
+
+	client := newTransport("client")
+	assert.NoError(t, client.Dial(server.listener.Addr().String()), "Dialing should not error")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-peers:
+			_, ok := p.(*TCPPeer).Conn.(*tls.Conn)
+			assert.True(t, ok, "Peer connection should use TLS")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for peers")
+		}
+	}
+}
@@ -6,14 +6,39 @@ import "net"
 type RPC struct {
 	From    string
 	Payload []byte
-	Stream  bool
+	// Type is the frame type and StreamID the stream a stream frame
+	// belongs to. Stream frames are handled by the transport and never
+	// reach Consume.
+	Type     byte
+	StreamID uint32
 }
 
-// Peer represents a remote node in the network
+// Peer represents a remote node in the network. Once the handshake is
+// done the connection is owned by the transport: data is exchanged with
+// Send and over streams rather than by reading or writing the peer.
 type Peer interface {
 	net.Conn
+	// Send writes one framed message to the peer
 	Send([]byte) error
-	CloseStream()
+	// OpenStream opens a new logical stream to the peer. Its ID is sent
+	// along in a message so the peer can pick it up with AcceptStream.
+	OpenStream() (*Stream, error)
+	// AcceptStream returns a stream the peer opened
+	AcceptStream(id uint32) (*Stream, error)
+	// Info returns the identity the peer proved in the handshake, which
+	// is empty when the handshake does not exchange identities
+	Info() PeerInfo
+	// Outbound reports whether this node dialed the connection
+	Outbound() bool
+}
+
+// PeerID returns the node ID of a peer, falling back to its remote
+// address when the handshake did not establish one
+func PeerID(p Peer) string {
+	if id := p.Info().NodeID; len(id) > 0 {
+		return id
+	}
+	return p.RemoteAddr().String()
 }
 
 // Transport handles communication between nodes in the network
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+)
+
+const (
+	defaultPeerDegree           = 8
+	defaultPeerExchangeInterval = 10 * time.Second
+	// maxExchangedPeers bounds the peers shared in one exchange
+	maxExchangedPeers = 32
+	// maxKnownPeers bounds the discovered peers a node remembers; the
+	// ones heard of least recently are forgotten first
+	maxKnownPeers = 1024
+	// dialTimeout is how long a discovered peer counts as being dialed
+	dialTimeout = 10 * time.Second
+)
+
+// PeerAddr is a node and the address it accepts connections on
+type PeerAddr struct {
+	ID   string
+	Addr string
+}
+
+// MessagePeerExchange shares the peers a node is connected to
+type MessagePeerExchange struct {
+	Peers []PeerAddr
+}
+
+// knownPeer is a discovered node's listen address and when it was last
+// heard of
+type knownPeer struct {
+	addr string
+	seen time.Time
+}
+
+// listenAddr returns the address a peer can be dialed on: the listen
+// address it advertised in the handshake, with the host it connected
+// from filled in when it advertised only a port
+func listenAddr(p p2p.Peer) string {
+	addr := p.Info().ListenAddr
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || len(host) > 0 {
+		return addr
+	}
+
+	remoteHost, _, err := net.SplitHostPort(p.RemoteAddr().String())
+	if err != nil {
+		return addr
+	}
+
+	return net.JoinHostPort(remoteHost, port)
+}
+
+// sameAddr reports whether two listen addresses reach the same node. An
+// address without a host, like ":3000", is one on the local host.
+func sameAddr(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	hostA, portA, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	hostB, portB, err := net.SplitHostPort(b)
+	if err != nil || portA != portB {
+		return false
+	}
+
+	return hostA == hostB || (localHost(hostA) && localHost(hostB))
+}
+
+// localHost reports whether a host names the local host
+func localHost(host string) bool {
+	if len(host) == 0 || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+// sendPeerExchange sends a random sample of the connected peers to peer
+func (s *FileServer) sendPeerExchange(peer p2p.Peer) {
+	if s.PeerDegree < 0 {
+		return
+	}
+
+	to := p2p.PeerID(peer)
+	peers := []PeerAddr{}
+	for _, p := range s.peerList() {
+		id, addr := p2p.PeerID(p), listenAddr(p)
+		if id == to || len(addr) == 0 {
+			continue
+		}
+		peers = append(peers, PeerAddr{ID: id, Addr: addr})
+	}
+
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > maxExchangedPeers {
+		peers = peers[:maxExchangedPeers]
+	}
+
+	msg := Message{
+		Payload: MessagePeerExchange{Peers: peers},
+	}
+	if err := s.send(peer, &msg); err != nil {
+		log.Printf("[%s] sending peers to (%s): %v", s.Transport.Addr(), to, err)
+	}
+}
+
+// handleMessagePeerExchange records the peers a neighbour knows about
+// and connects to some of them if this node has too few peers
+func (s *FileServer) handleMessagePeerExchange(from string, msg MessagePeerExchange) error {
+	self := s.nodeID()
+	peers := msg.Peers
+	if len(peers) > maxExchangedPeers {
+		peers = peers[:maxExchangedPeers]
+	}
+
+	s.peerLock.Lock()
+	now := time.Now()
+	for _, p := range peers {
+		if p.ID != self && len(p.Addr) > 0 {
+			s.known[p.ID] = knownPeer{addr: p.Addr, seen: now}
+		}
+	}
+	s.forgetOldPeers()
+	s.peerLock.Unlock()
+
+	go s.connectKnownPeers()
+
+	return nil
+}
+
+// forgetOldPeers drops the peers heard of least recently until no more
+// than maxKnownPeers are known; s.peerLock must be held
+func (s *FileServer) forgetOldPeers() {
+	for len(s.known) > maxKnownPeers {
+		var oldest string
+		for id, p := range s.known {
+			if len(oldest) == 0 || p.seen.Before(s.known[oldest].seen) {
+				oldest = id
+			}
+		}
+		delete(s.known, oldest)
+	}
+}
+
+// connectKnownPeers dials known nodes that are not connected until the
+// node has PeerDegree peers. Bootstrap nodes are left to the ConnManager.
+func (s *FileServer) connectKnownPeers() {
+	if s.PeerDegree < 0 {
+		return
+	}
+
+	s.peerLock.Lock()
+	now := time.Now()
+	for addr, since := range s.dialing {
+		if now.Sub(since) > dialTimeout {
+			delete(s.dialing, addr)
+		}
+	}
+
+	candidates := []string{}
+	for id, known := range s.known {
+		addr := known.addr
+		if _, ok := s.peers[id]; ok {
+			continue
+		}
+		if _, ok := s.dialing[addr]; ok {
+			continue
+		}
+		if slices.ContainsFunc(s.BootstrapNodes, func(node string) bool { return sameAddr(node, addr) }) {
+			continue
+		}
+		candidates = append(candidates, addr)
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	missing := max(s.PeerDegree-len(s.peers)-len(s.dialing), 0)
+	if len(candidates) > missing {
+		candidates = candidates[:missing]
+	}
+	for _, addr := range candidates {
+		s.dialing[addr] = now
+	}
+	s.peerLock.Unlock()
+
+	for _, addr := range candidates {
+		fmt.Printf("[%s] connecting to discovered peer %s\n", s.Transport.Addr(), addr)
+		if err := s.Transport.Dial(addr); err != nil {
+			log.Printf("[%s] dialing discovered peer %s: %v", s.Transport.Addr(), addr, err)
+			s.forgetAddr(addr)
+		}
+	}
+}
+
+// forgetAddr drops a known address that could not be dialed
+func (s *FileServer) forgetAddr(addr string) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	delete(s.dialing, addr)
+	for id, known := range s.known {
+		if known.addr == addr {
+			delete(s.known, id)
+		}
+	}
+}
+
+// peerExchangeLoop periodically shares the peer list with a random peer
+// and tops up the connections
+func (s *FileServer) peerExchangeLoop() {
+	if s.PeerDegree < 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.PeerExchangeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if peers := s.peerList(); len(peers) > 0 {
+				s.sendPeerExchange(peers[rand.IntN(len(peers))])
+			}
+			s.connectKnownPeers()
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerExchangeDiscovery(t *testing.T) {
+	network := p2p.NewMemoryNetwork()
+	servers := make([]*FileServer, 10)
+
+	// Every node only knows node0 and has to find the rest through it
+	for i := range servers {
+		addr := fmt.Sprintf("node%d", i)
+		nodes := []string{"node0"}
+		if i == 0 {
+			nodes = nil
+		}
+		servers[i] = newMemoryServer(t, network, nil, addr, nodes...)
+		servers[i].PeerDegree = 4
+		servers[i].PeerExchangeInterval = 50 * time.Millisecond
+		assert.NoError(t, servers[i].Transport.ListenAndAccept(), "Listening should not error")
+	}
+
+	for _, s := range servers {
+		s.bootstrapNetwork()
+		go s.loop()
+	}
+
+	waitForCluster(t, len(servers), func() bool {
+		for _, s := range servers[1:] {
+			if len(s.peerList()) < 4 {
+				return false
+			}
+		}
+		return true
+	}, "every node should discover peers up to the target degree")
+
+	for _, s := range servers[1:] {
+		assert.Len(t, s.Connections(), 1, "Discovered peers should not be managed as bootstrap nodes")
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{":3000", "127.0.0.1:3000", true},
+		{"localhost:3000", "[::1]:3000", true},
+		{"10.0.0.5:3000", "10.0.0.5:3000", true},
+		{":3000", "10.0.0.5:3000", false},
+		{":3000", "127.0.0.1:4000", false},
+		{"node0", "node0", true},
+		{"node0", "node1", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, sameAddr(tt.a, tt.b), "%s and %s", tt.a, tt.b)
+	}
+}
+
+func TestPeerExchangeForgetsOldPeers(t *testing.T) {
+	s := newMemoryServer(t, p2p.NewMemoryNetwork(), nil, "node0")
+	s.PeerDegree = -1
+
+	// A peer keeps sending new nodes, more than a node remembers
+	var latest []PeerAddr
+	for i := range maxKnownPeers/maxExchangedPeers + 2 {
+		latest = nil
+		for j := range maxExchangedPeers {
+			latest = append(latest, PeerAddr{ID: generateID(), Addr: fmt.Sprintf("node%d-%d", i, j)})
+		}
+		assert.NoError(t, s.handleMessagePeerExchange("spy", MessagePeerExchange{Peers: latest}), "Handling peers should not error")
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	assert.Len(t, s.known, maxKnownPeers, "Known peers should be capped")
+	for _, p := range latest {
+		assert.Contains(t, s.known, p.ID, "Peers heard of last should be kept")
+	}
+}
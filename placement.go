@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"time"
+)
+
+// currentRing returns the hash ring of the members not declared dead,
+// rebuilding it when membership changed
+func (s *FileServer) currentRing() *HashRing {
+	live := s.members.Live()
+
+	s.ringLock.Lock()
+	defer s.ringLock.Unlock()
+
+	if s.ring == nil || !slices.Equal(s.ring.Nodes(), live) {
+		s.ring = NewHashRing(s.VirtualNodes, live...)
+	}
+	return s.ring
+}
+
+// owners returns the nodes that keep the replicas of an object
+func (s *FileServer) owners(owner, name string) []Contact {
+	return s.contacts(s.currentRing().Owners(objectKadID(owner, name), s.ReplicationFactor, owner))
+}
+
+// contacts resolves member IDs to contacts
+func (s *FileServer) contacts(ids []string) []Contact {
+	contacts := make([]Contact, 0, len(ids))
+	for _, id := range ids {
+		if member, ok := s.members.Member(id); ok {
+			contacts = append(contacts, Contact{ID: id, Addr: member.Addr})
+		}
+	}
+	return contacts
+}
+
+// rebalanceLoop moves replicas to their new owners whenever members join
+// or leave the ring, checking once per protocol period. A rebalance that
+// could not hand everything off is retried.
+func (s *FileServer) rebalanceLoop() {
+	prev := s.currentRing()
+
+	ticker := time.NewTicker(s.members.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if ring := s.currentRing(); ring != prev && s.rebalance(prev, ring) {
+				prev = ring
+			}
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// rebalance hands the replicas this node holds to the owners they gained
+// going from prev to next, and drops the ones it no longer owns. The
+// first node in ring order that owns an object before and after hands it
+// over, so the remaining owners do not all send it; a node that finds no
+// such owner sends it itself. A node giving up a replica sends it to all
+// the new owners first, since other nodes may see a different ring. It
+// reports whether every handoff succeeded.
+func (s *FileServer) rebalance(prev, next *HashRing) bool {
+	refs, err := s.store.List()
+	if err != nil {
+		log.Printf("[%s] listing objects to rebalance: %v", s.Transport.Addr(), err)
+		return false
+	}
+
+	done := true
+	self := s.nodeID()
+	for _, ref := range refs {
+		// This node's own objects are not placed by the ring
+		if ref.ID == s.ID {
+			continue
+		}
+
+		object := objectKadID(ref.ID, ref.Key)
+		before := prev.Owners(object, s.ReplicationFactor, ref.ID)
+		after := next.Owners(object, s.ReplicationFactor, ref.ID)
+
+		kept := []string{}
+		gained := []string{}
+		for _, id := range after {
+			if slices.Contains(before, id) {
+				kept = append(kept, id)
+			} else if id != self {
+				gained = append(gained, id)
+			}
+		}
+		if len(kept) == 0 {
+			gained = slices.DeleteFunc(slices.Clone(after), func(id string) bool { return id == self })
+		}
+
+		owned := slices.Contains(after, self)
+		targets := []string{}
+		if !owned {
+			targets = after
+		} else if len(kept) == 0 || kept[0] == self {
+			targets = gained
+		}
+
+		if len(targets) > 0 {
+			if err := s.handoff(ref, s.contacts(targets)); err != nil {
+				log.Printf("[%s] handing off (%s): %v", s.Transport.Addr(), ref.Key, err)
+				// Keep the replica until someone else has it
+				done = false
+				continue
+			}
+		}
+
+		if !owned {
+			if err := s.store.Delete(ref.ID, ref.Key); err != nil {
+				log.Printf("[%s] dropping replica (%s): %v", s.Transport.Addr(), ref.Key, err)
+			}
+		}
+	}
+
+	return done
+}
+
+// handoff sends a replica this node holds to new owners
+func (s *FileServer) handoff(ref ObjectRef, targets []Contact) error {
+	meta, err := s.store.ReadMeta(ref.ID, ref.Key)
+	if err != nil {
+		return err
+	}
+	if meta.Provenance == nil {
+		return fmt.Errorf("replica has no provenance")
+	}
+
+	_, r, err := s.store.Read(ref.ID, ref.Key)
+	if err != nil {
+		return err
+	}
+	data := new(bytes.Buffer)
+	n, err := io.Copy(data, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(data.Bytes())
+	if err := meta.Provenance.VerifyContent(ref.Key, n, hash[:]); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	holders := s.replicate(ctx, ref.ID, *meta.Provenance, data.Bytes(), targets)
+	// The object may have been deleted while it was being sent
+	if !s.store.Has(ref.ID, ref.Key) {
+		return fmt.Errorf("replica was deleted during the handoff")
+	}
+	s.announce(ctx, ref.ID, ref.Key, holders)
+
+	if len(holders) < len(targets) {
+		return fmt.Errorf("%d of %d new owners took the replica", len(holders), len(targets))
+	}
+	return nil
+}
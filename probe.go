@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+)
+
+// MessagePing probes whether a member is alive
+type MessagePing struct {
+	SeqNo uint64
+}
+
+// MessagePingReq asks a peer to probe Target on the sender's behalf
+type MessagePingReq struct {
+	SeqNo  uint64
+	Target string
+}
+
+// MessageAck answers a ping, directly or relayed for a ping request
+type MessageAck struct {
+	SeqNo uint64
+}
+
+// MessageMembers carries a node's full membership view to a new peer
+type MessageMembers struct {
+	Members []MemberUpdate
+}
+
+// Members returns this node's view of the cluster
+func (s *FileServer) Members() []Member {
+	return s.members.Members()
+}
+
+// probeLoop probes one member every protocol period and declares members
+// dead whose suspicion was not refuted in time
+func (s *FileServer) probeLoop() {
+	ticker := time.NewTicker(s.members.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, id := range s.members.ExpireSuspects() {
+				log.Printf("[%s] member (%s) is dead", s.Transport.Addr(), id)
+			}
+			if id, ok := s.members.nextProbeTarget(); ok {
+				go s.probe(id)
+			}
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// probe pings a member directly, then through other peers, and suspects
+// it when no ack arrives within the protocol period
+func (s *FileServer) probe(id string) {
+	seqNo, acked := s.members.expectAck(id)
+	defer s.members.forgetAck(seqNo)
+
+	// A member this node is not connected to can only be probed indirectly
+	if peer, ok := s.peer(id); ok {
+		msg := Message{Payload: MessagePing{SeqNo: seqNo}}
+		// Tell a member believed suspect or dead so it can refute it
+		if member, ok := s.members.Member(id); ok && member.State != MemberAlive {
+			msg.Gossip = []MemberUpdate{member.update()}
+		}
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("[%s] pinging (%s): %v", s.Transport.Addr(), id, err)
+		}
+	}
+
+	if s.waitAck(acked, s.members.ProbeTimeout) {
+		return
+	}
+
+	proxies := []p2p.Peer{}
+	for _, peer := range s.peerList() {
+		if p2p.PeerID(peer) != id {
+			proxies = append(proxies, peer)
+		}
+	}
+	rand.Shuffle(len(proxies), func(i, j int) {
+		proxies[i], proxies[j] = proxies[j], proxies[i]
+	})
+	if len(proxies) > s.members.IndirectProbes {
+		proxies = proxies[:s.members.IndirectProbes]
+	}
+
+	for _, peer := range proxies {
+		s.members.allowAck(seqNo, p2p.PeerID(peer))
+		msg := Message{
+			Payload: MessagePingReq{SeqNo: seqNo, Target: id},
+		}
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("[%s] asking (%s) to ping (%s): %v", s.Transport.Addr(), p2p.PeerID(peer), id, err)
+		}
+	}
+
+	if s.waitAck(acked, s.members.ProbeInterval-s.members.ProbeTimeout) {
+		return
+	}
+
+	if s.members.Suspect(id) {
+		log.Printf("[%s] member (%s) is suspect", s.Transport.Addr(), id)
+	}
+}
+
+// waitAck waits up to timeout for a probe to be acked
+func (s *FileServer) waitAck(acked chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-acked:
+		return true
+	case <-timer.C:
+	case <-s.quitch:
+	}
+	return false
+}
+
+// sendMembers sends this node's membership view to a new peer
+func (s *FileServer) sendMembers(peer p2p.Peer) {
+	msg := Message{
+		Payload: MessageMembers{Members: s.members.Snapshot()},
+	}
+	if err := s.send(peer, &msg); err != nil {
+		log.Printf("[%s] sending members to (%s): %v", s.Transport.Addr(), p2p.PeerID(peer), err)
+	}
+}
+
+// applyGossip merges the membership updates piggybacked on a message
+func (s *FileServer) applyGossip(updates []MemberUpdate) {
+	self := s.nodeID()
+	for _, u := range updates {
+		if s.members.Apply(u) && u.State != MemberAlive && u.ID != self {
+			log.Printf("[%s] member (%s) is %s (incarnation %d)", s.Transport.Addr(), u.ID, u.State, u.Incarnation)
+		}
+	}
+}
+
+func (s *FileServer) handleMessageMembers(from string, msg MessageMembers) error {
+	s.applyGossip(msg.Members)
+	return nil
+}
+
+func (s *FileServer) handleMessagePing(from string, msg MessagePing) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	return s.send(peer, &Message{Payload: MessageAck{SeqNo: msg.SeqNo}})
+}
+
+// handleMessagePingReq pings the target and relays its ack to the sender
+func (s *FileServer) handleMessagePingReq(from string, msg MessagePingReq) error {
+	target, ok := s.peer(msg.Target)
+	if !ok {
+		return nil
+	}
+
+	go func() {
+		seqNo, acked := s.members.expectAck(msg.Target)
+		defer s.members.forgetAck(seqNo)
+
+		if err := s.send(target, &Message{Payload: MessagePing{SeqNo: seqNo}}); err != nil {
+			return
+		}
+		if !s.waitAck(acked, s.members.ProbeTimeout) {
+			return
+		}
+
+		if peer, ok := s.peer(from); ok {
+			s.send(peer, &Message{Payload: MessageAck{SeqNo: msg.SeqNo}})
+		}
+	}()
+
+	return nil
+}
+
+func (s *FileServer) handleMessageAck(from string, msg MessageAck) error {
+	s.members.ack(msg.SeqNo, from)
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+)
+
+const (
+	// maxProvenanceSize bounds the provenance record read from a peer
+	maxProvenanceSize = 64 * 1024
+	// maxProvenanceSkew is how far ahead of this node's clock a replica
+	// may be signed
+	maxProvenanceSkew = time.Minute
+)
+
+// ErrInvalidProvenance is returned when an object's signature does not
+// match its author, key or content
+var ErrInvalidProvenance = errors.New("invalid provenance")
+
+// Provenance records who authored an object and exactly what they stored.
+// It is signed by the originating node and kept alongside every copy.
+type Provenance struct {
+	Key       string
+	Hash      []byte
+	Size      int64
+	Timestamp int64
+	Author    ed25519.PublicKey
+	Signature []byte
+}
+
+// newProvenance signs the replica stream stored under key
+func newProvenance(priv ed25519.PrivateKey, key string, data []byte) Provenance {
+	hash := sha256.Sum256(data)
+
+	p := Provenance{
+		Key:       key,
+		Hash:      hash[:],
+		Size:      int64(len(data)),
+		Timestamp: time.Now().UnixNano(),
+		Author:    priv.Public().(ed25519.PublicKey),
+	}
+	p.Signature = ed25519.Sign(priv, p.signedBytes())
+
+	return p
+}
+
+// signedBytes returns the canonical encoding covered by the signature
+func (p Provenance) signedBytes() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("drift-provenance-v1")
+	binary.Write(buf, binary.BigEndian, uint32(len(p.Key)))
+	buf.WriteString(p.Key)
+	buf.Write(p.Hash)
+	binary.Write(buf, binary.BigEndian, p.Size)
+	binary.Write(buf, binary.BigEndian, p.Timestamp)
+	return buf.Bytes()
+}
+
+// Verify checks that the signature was made by the recorded author
+func (p Provenance) Verify() error {
+	if len(p.Author) != ed25519.PublicKeySize || len(p.Hash) != sha256.Size {
+		return ErrInvalidProvenance
+	}
+	if !ed25519.Verify(p.Author, p.signedBytes(), p.Signature) {
+		return ErrInvalidProvenance
+	}
+	return nil
+}
+
+// VerifyOwner checks that the signature was made by the owner whose node
+// ID the object is stored under, and that it is not dated too far in the
+// future, where it would supersede every later version
+func (p Provenance) VerifyOwner(id string) error {
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	if p2p.NodeIDFromKey(p.Author) != id {
+		return fmt.Errorf("%w: object was not signed by its owner", ErrInvalidProvenance)
+	}
+	if time.Unix(0, p.Timestamp).After(time.Now().Add(maxProvenanceSkew)) {
+		return fmt.Errorf("%w: object is dated in the future", ErrInvalidProvenance)
+	}
+	return nil
+}
+
+// VerifyContent checks the signature and that it covers the given key,
+// size and content hash
+func (p Provenance) VerifyContent(key string, size int64, hash []byte) error {
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	if p.Key != key {
+		return fmt.Errorf("%w: signed for key %s, not %s", ErrInvalidProvenance, p.Key, key)
+	}
+	if p.Size != size || !bytes.Equal(p.Hash, hash) {
+		return fmt.Errorf("%w: content does not match signature", ErrInvalidProvenance)
+	}
+	return nil
+}
+
+// verifyAuthor checks that an object was signed by author for the given
+// key and content
+func verifyAuthor(prov *Provenance, author ed25519.PublicKey, key string, size int64, hash []byte) error {
+	if prov == nil {
+		return fmt.Errorf("%w: object is not signed", ErrInvalidProvenance)
+	}
+	if !prov.Author.Equal(author) {
+		return fmt.Errorf("%w: object was signed by another node", ErrInvalidProvenance)
+	}
+	return prov.VerifyContent(key, size, hash)
+}
+
+// verifyCopy checks that a stored copy was signed by author for key,
+// leaving it ready to be read from the start
+func verifyCopy(r io.Reader, prov *Provenance, author ed25519.PublicKey, key string) error {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return errors.New("stored copy cannot be verified before reading")
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		return err
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return verifyAuthor(prov, author, key, n, hash.Sum(nil))
+}
+
+// writeProvenance writes a length-prefixed provenance record to a stream.
+// A nil record is written as zero length.
+func writeProvenance(w io.Writer, p *Provenance) error {
+	var b []byte
+	if p != nil {
+		var err error
+		if b, err = json.Marshal(p); err != nil {
+			return err
+		}
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readProvenance reads a record written by writeProvenance
+func readProvenance(r io.Reader) (*Provenance, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n > maxProvenanceSize {
+		return nil, fmt.Errorf("provenance record too large: %d bytes", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	p := new(Provenance)
+	return p, json.Unmarshal(b, p)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvenanceSignAndVerify(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+
+	data := []byte("This is the replica stream")
+	hash := sha256.Sum256(data)
+	prov := newProvenance(priv, "object_key", data)
+
+	assert.NoError(t, prov.Verify(), "Fresh provenance should verify")
+	assert.NoError(t, prov.VerifyContent("object_key", int64(len(data)), hash[:]), "Content should match provenance")
+
+	other := sha256.Sum256([]byte("Substituted content"))
+	assert.ErrorIs(t, prov.VerifyContent("object_key", int64(len(data)), other[:]), ErrInvalidProvenance, "Substituted content should fail")
+	assert.ErrorIs(t, prov.VerifyContent("other_key", int64(len(data)), hash[:]), ErrInvalidProvenance, "Another key should fail")
+
+	forged := prov
+	forged.Timestamp++
+	assert.ErrorIs(t, forged.Verify(), ErrInvalidProvenance, "Tampered fields should fail")
+
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+	forged = prov
+	forged.Author = otherPriv.Public().(ed25519.PublicKey)
+	assert.ErrorIs(t, forged.Verify(), ErrInvalidProvenance, "Another author should fail")
+}
+
+func TestProvenanceStreamRoundTrip(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+
+	prov := newProvenance(priv, "object_key", []byte("data"))
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeProvenance(&buf, &prov), "Writing provenance should not error")
+	assert.NoError(t, writeProvenance(&buf, nil), "Writing empty provenance should not error")
+
+	got, err := readProvenance(&buf)
+	assert.NoError(t, err, "Reading provenance should not error")
+	assert.Equal(t, &prov, got, "Provenance should round trip")
+	assert.NoError(t, got.Verify(), "Round tripped provenance should verify")
+
+	got, err = readProvenance(&buf)
+	assert.NoError(t, err, "Reading empty provenance should not error")
+	assert.Nil(t, got, "Empty provenance should read as nil")
+}
+
+func TestGetVerifiesLocalCopy(t *testing.T) {
+	servers := startCluster(t, 4, nil)
+
+	for i, atRest := range []bool{false, true} {
+		s := servers[i]
+		s.EncryptAtRest = atRest
+		key := "tampered.txt"
+		data := []byte("the signed local copy")
+
+		assert.NoError(t, s.Store(key, bytes.NewReader(data)), "Store should not error")
+
+		// Swap the local copy on disk, leaving its metadata alone
+		_, err := s.store.Write(s.ID, key, bytes.NewReader([]byte("not what was stored")))
+		assert.NoError(t, err, "Tampering with the local copy should not error")
+
+		_, err = s.readLocal(key)
+		assert.ErrorIs(t, err, ErrInvalidProvenance, "Tampered local copy should fail verification")
+
+		r, err := s.Get(key)
+		if !assert.NoError(t, err, "Get should fetch the file again") {
+			continue
+		}
+		b, err := io.ReadAll(r)
+		assert.NoError(t, err, "Reading the file should not error")
+		r.(io.Closer).Close()
+		assert.Equal(t, data, b, "Get should return the stored file, not the tampered copy")
+
+		_, err = s.readLocal(key)
+		assert.NoError(t, err, "Fetched local copy should verify")
+	}
+}
+
+func TestForgedReplicaIsRejected(t *testing.T) {
+	servers := startSettledCluster(t, 4)
+	s, spy := servers[0], servers[1]
+	key := "victim.txt"
+	data := []byte("written by the owner")
+
+	s.WriteConsistency = ConsistencyAll
+	assert.NoError(t, s.Store(key, bytes.NewReader(data)), "Store should not error")
+	name := s.hashObjectKey(key)
+	holder := ringOwners(s, key, servers)[0]
+
+	forged := []byte("written by a spy")
+	tests := map[string]Provenance{
+		"another node's key": newProvenance(spy.IdentityKey, name, forged),
+		"a future date": func() Provenance {
+			prov := newProvenance(s.IdentityKey, name, forged)
+			prov.Timestamp = time.Now().Add(time.Hour).UnixNano()
+			prov.Signature = ed25519.Sign(s.IdentityKey, prov.signedBytes())
+			return prov
+		}(),
+	}
+	for signed, prov := range tests {
+		_, _, err := holder.storeReplica(s.ID, prov.Key, prov, bytes.NewReader(forged))
+		assert.ErrorIs(t, err, ErrInvalidProvenance, "Replica signed with %s should be rejected", signed)
+	}
+
+	assertFetch(t, s, key, data)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+)
+
+// ErrReadConsistency is returned by a read that fewer owners answered
+// than its consistency level needs
+var ErrReadConsistency = errors.New("read consistency not reached")
+
+// MessageGetMeta asks a node which version of a file it holds. The
+// answer carries the file's provenance instead of the file.
+type MessageGetMeta struct {
+	RequestID uint64
+	ID        string
+	Key       string
+}
+
+// replicaVersion is the version of an object a peer reported; prov is
+// nil when the peer does not hold a valid copy
+type replicaVersion struct {
+	peer p2p.Peer
+	prov *Provenance
+}
+
+// readVersions asks peers for the version of an object they hold and
+// returns once required of them answered. Versions not signed by author
+// for the object count as missing copies.
+func (s *FileServer) readVersions(ctx context.Context, peers []p2p.Peer, required int, id string, name string, author ed25519.PublicKey) ([]replicaVersion, error) {
+	responses := make(chan MessageResponse, len(peers))
+	requests := make(map[uint64]p2p.Peer)
+	defer func() {
+		for reqID := range requests {
+			s.forgetResponse(reqID)
+		}
+	}()
+
+	for _, peer := range peers {
+		reqID := s.expectResponse(peer, responses)
+		msg := Message{
+			Payload: MessageGetMeta{
+				RequestID: reqID,
+				ID:        id,
+				Key:       name,
+			},
+		}
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("[%s] asking (%s) for the version of (%s): %v", s.Transport.Addr(), p2p.PeerID(peer), name, err)
+			s.forgetResponse(reqID)
+			continue
+		}
+		requests[reqID] = peer
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	versions := []replicaVersion{}
+	for len(versions) < required && len(requests) > 0 {
+		var resp MessageResponse
+		select {
+		case resp = <-responses:
+		case <-timer.C:
+			return nil, fmt.Errorf("%w: %d of %d owners answered within %s", ErrReadConsistency, len(versions), required, s.RequestTimeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.quitch:
+			return nil, errServerStopped
+		}
+
+		// A request whose send failed can still be failed by the disconnect
+		peer, ok := requests[resp.RequestID]
+		if !ok {
+			continue
+		}
+		delete(requests, resp.RequestID)
+
+		switch resp.Status {
+		case StatusOK:
+			prov := resp.Provenance
+			if err := verifyVersion(prov, author, name); err != nil {
+				log.Printf("[%s] rejecting version of (%s) from (%s): %v", s.Transport.Addr(), name, p2p.PeerID(peer), err)
+				prov = nil
+			}
+			versions = append(versions, replicaVersion{peer: peer, prov: prov})
+		case StatusNotFound:
+			versions = append(versions, replicaVersion{peer: peer})
+		default:
+			log.Printf("[%s] asking (%s) for the version of (%s): %v", s.Transport.Addr(), p2p.PeerID(peer), name, resp.Err())
+		}
+	}
+
+	if len(versions) < required {
+		return nil, fmt.Errorf("%w: %d of %d owners answered", ErrReadConsistency, len(versions), required)
+	}
+	return versions, nil
+}
+
+// verifyVersion checks that a reported version was signed by author for
+// the object. The content is only checked once it is fetched.
+func verifyVersion(prov *Provenance, author ed25519.PublicKey, name string) error {
+	if prov == nil {
+		return verifyAuthor(nil, author, name, 0, nil)
+	}
+	return verifyAuthor(prov, author, name, prov.Size, prov.Hash)
+}
+
+// newestVersion returns the version with the latest timestamp, preferring
+// the one most peers agree on when timestamps tie, or nil if no peer
+// holds the object
+func newestVersion(versions []replicaVersion) *Provenance {
+	var newest *Provenance
+	agreed := 0
+	for _, v := range versions {
+		if v.prov == nil {
+			continue
+		}
+
+		n := 0
+		for _, other := range versions {
+			if other.prov != nil && bytes.Equal(other.prov.Hash, v.prov.Hash) {
+				n++
+			}
+		}
+
+		switch {
+		case newest == nil,
+			v.prov.Timestamp > newest.Timestamp,
+			v.prov.Timestamp == newest.Timestamp && n > agreed,
+			v.prov.Timestamp == newest.Timestamp && n == agreed && bytes.Compare(v.prov.Hash, newest.Hash) > 0:
+			newest, agreed = v.prov, n
+		}
+	}
+	return newest
+}
+
+// holding returns the peers that hold the given version
+func holding(versions []replicaVersion, prov *Provenance) []p2p.Peer {
+	peers := []p2p.Peer{}
+	for _, v := range versions {
+		if v.prov != nil && bytes.Equal(v.prov.Hash, prov.Hash) {
+			peers = append(peers, v.peer)
+		}
+	}
+	return peers
+}
+
+// stale returns the peers that are missing the given version
+func stale(versions []replicaVersion, prov *Provenance) []Contact {
+	contacts := []Contact{}
+	for _, v := range versions {
+		if v.prov == nil || !bytes.Equal(v.prov.Hash, prov.Hash) {
+			contacts = append(contacts, Contact{ID: p2p.PeerID(v.peer), Addr: listenAddr(v.peer)})
+		}
+	}
+	return contacts
+}
+
+// repair sends the newest version of an object to the owners that
+// reported a missing or older copy
+func (s *FileServer) repair(id string, prov Provenance, data []byte, targets []Contact) {
+	if len(targets) == 0 {
+		return
+	}
+
+	fmt.Printf("[%s] repairing (%s) on %d stale replicas\n", s.Transport.Addr(), prov.Key, len(targets))
+
+	ctx := context.Background()
+	holders := s.replicate(ctx, id, prov, data, targets)
+	s.announce(ctx, id, prov.Key, holders)
+}
+
+// handleMessageGetMeta answers with the version of a file this node
+// holds
+func (s *FileServer) handleMessageGetMeta(from string, msg MessageGetMeta) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	meta, ok := s.servedMeta(msg.ID, msg.Key)
+	if !ok {
+		return s.send(peer, &Message{
+			Payload: MessageResponse{RequestID: msg.RequestID, Status: StatusNotFound},
+		})
+	}
+
+	resp := newResponse(msg.RequestID, meta.Provenance.Size, nil)
+	resp.Provenance = meta.Provenance
+	return s.send(peer, &Message{Payload: resp})
+}
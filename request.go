@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+)
+
+// defaultRequestTimeout bounds how long a file request waits for its answer
+const defaultRequestTimeout = 5 * time.Second
+
+// errSuperseded is returned for a replica refused by a node holding a
+// newer version of the file
+var errSuperseded = errors.New("a newer version is stored")
+
+// ResponseStatus is the outcome of a file request
+type ResponseStatus uint8
+
+const (
+	// StatusOK means the file was found, or stored
+	StatusOK ResponseStatus = iota + 1
+	// StatusNotFound means the node does not hold the file
+	StatusNotFound
+	// StatusError means the node failed to serve or store the file
+	StatusError
+	// StatusSuperseded means the node holds a newer version of the file
+	// than the one it was sent
+	StatusSuperseded
+)
+
+func (s ResponseStatus) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusNotFound:
+		return "not found"
+	case StatusError:
+		return "error"
+	case StatusSuperseded:
+		return "superseded"
+	default:
+		return fmt.Sprintf("status(%d)", s)
+	}
+}
+
+// MessageResponse answers MessageGetFile before the file is sent,
+// MessageStoreFile once the replica is written, MessageGetMeta and
+// MessageSyncTree
+type MessageResponse struct {
+	RequestID uint64
+	Status    ResponseStatus
+	// Size is the size of the file served or stored
+	Size int64
+	// Checksum is the SHA-256 of the replica as it was stored
+	Checksum []byte
+	// Provenance is the version of the file held, for MessageGetMeta
+	Provenance *Provenance
+	// Hashes and Entries are the Merkle tree nodes asked for by
+	// MessageSyncTree
+	Hashes  [][]byte
+	Entries []SyncEntry
+	Error   string
+}
+
+// Err returns the failure a response reports, if any
+func (r MessageResponse) Err() error {
+	switch r.Status {
+	case StatusOK:
+		return nil
+	case StatusError:
+		return fmt.Errorf("remote error: %s", r.Error)
+	case StatusSuperseded:
+		return errSuperseded
+	default:
+		return fmt.Errorf("remote answered %s", r.Status)
+	}
+}
+
+// pendingRequest is a request waiting for the response of one peer
+type pendingRequest struct {
+	peer     p2p.Peer
+	response chan MessageResponse
+}
+
+// expectResponse returns a new request ID whose response from peer is
+// delivered on ch. Requests to several peers may share one channel.
+func (s *FileServer) expectResponse(peer p2p.Peer, ch chan MessageResponse) uint64 {
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	s.requestID++
+	s.requests[s.requestID] = pendingRequest{peer: peer, response: ch}
+	return s.requestID
+}
+
+// forgetResponse stops waiting for the response to a request
+func (s *FileServer) forgetResponse(id uint64) {
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	delete(s.requests, id)
+}
+
+// awaitResponse waits up to RequestTimeout, or until ctx is done, for the
+// response to a single request and forgets the request
+func (s *FileServer) awaitResponse(ctx context.Context, id uint64, ch chan MessageResponse) (MessageResponse, error) {
+	defer s.forgetResponse(id)
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-timer.C:
+		return MessageResponse{}, fmt.Errorf("no response within %s", s.RequestTimeout)
+	case <-ctx.Done():
+		return MessageResponse{}, ctx.Err()
+	case <-s.quitch:
+		return MessageResponse{}, errServerStopped
+	}
+}
+
+// newResponse returns the answer to a request that failed with err, or
+// succeeded for a file of the given size
+func newResponse(id uint64, size int64, err error) MessageResponse {
+	resp := MessageResponse{RequestID: id, Status: StatusOK, Size: size}
+	switch {
+	case errors.Is(err, errSuperseded):
+		resp.Status = StatusSuperseded
+	case err != nil:
+		resp.Status = StatusError
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// sendResponse answers a request of a peer
+func (s *FileServer) sendResponse(peer p2p.Peer, id uint64, size int64, err error) error {
+	return s.send(peer, &Message{Payload: newResponse(id, size, err)})
+}
+
+// handleMessageResponse delivers a response to the request waiting for
+// it. Only the peer a request went to can answer it.
+func (s *FileServer) handleMessageResponse(from string, msg MessageResponse) error {
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	req, ok := s.requests[msg.RequestID]
+	if !ok || p2p.PeerID(req.peer) != from {
+		return nil
+	}
+	delete(s.requests, msg.RequestID)
+
+	// Channels are buffered for every request sharing them
+	req.response <- msg
+	return nil
+}
+
+// failRequests fails the requests sent over a connection that is gone,
+// as their streams went with it
+func (s *FileServer) failRequests(peer p2p.Peer, err error) {
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	for id, req := range s.requests {
+		if req.peer == peer {
+			delete(s.requests, id)
+			req.response <- MessageResponse{RequestID: id, Status: StatusError, Error: err.Error()}
+		}
+	}
+}
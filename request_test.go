@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchAnswersWithoutWaiting(t *testing.T) {
+	servers := startCluster(t, 3, nil)
+	s := servers[0]
+	author := s.IdentityKey.Public().(ed25519.PublicKey)
+
+	// Every peer says it lacks the file, so there is no timeout to wait for
+	start := time.Now()
+	_, _, err := s.fetchFrom(context.Background(), s.peerList(), s.ID, s.hashObjectKey("missing"), author)
+	assert.Error(t, err, "Fetching a file no peer holds should error")
+	assert.Less(t, time.Since(start), s.RequestTimeout, "Not-found answers should end the fetch before the timeout")
+
+	data := []byte("answered on request")
+	assert.NoError(t, s.Store("answered", bytes.NewReader(data)), "Store should not error")
+	// Store returns once the owners report the replica written
+	for _, owner := range ringOwners(s, "answered", servers) {
+		assert.True(t, owner.store.Has(s.ID, s.hashObjectKey("answered")), "Owner should hold the replica when Store returns")
+	}
+
+	got, _, err := s.fetchFrom(context.Background(), s.peerList(), s.ID, s.hashObjectKey("answered"), author)
+	assert.NoError(t, err, "Fetching a stored file should not error")
+	assert.NotEmpty(t, got, "Fetched replica should not be empty")
+}
+
+func TestContextEndsTransfers(t *testing.T) {
+	faults := p2p.NewFaultInjector(1)
+	servers := startCluster(t, 3, faults)
+	s := servers[0]
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	assert.NoError(t, s.Store("slow", bytes.NewReader(data)), "Store should not error")
+	assertReplicas(t, s, "slow", true, servers[1:]...)
+	assert.NoError(t, s.store.Delete(s.ID, "slow"), "Deleting local copy should not error")
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.GetContext(canceled, "slow")
+	assert.ErrorIs(t, err, context.Canceled, "Get with a canceled context should report it")
+	assert.NoError(t, s.Store("kept", bytes.NewReader(data)), "Store should not error")
+	assert.ErrorIs(t, s.DeleteContext(canceled, "kept"), context.Canceled, "Delete with a canceled context should report it")
+	assert.True(t, s.store.Has(s.ID, "kept"), "Canceled Delete should leave the file")
+
+	// The peers now hang on everything they send
+	for _, peer := range servers[1:] {
+		faults.SetNodeFaults(peer.Transport.Addr(), p2p.Faults{Latency: 10 * time.Second})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = s.GetContext(ctx, "slow")
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "Get past its deadline should report it")
+	assert.Less(t, time.Since(start), s.RequestTimeout, "Get should return at its deadline")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	err = s.StoreContext(ctx, "slower", bytes.NewReader(data))
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "Store past its deadline should report it")
+	assert.Less(t, time.Since(start), s.RequestTimeout, "Store should return at its deadline")
+	assert.True(t, s.store.Has(s.ID, "slower"), "Store should keep the local copy")
+}
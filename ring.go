@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultReplicationFactor = 3
+	defaultVirtualNodes      = 64
+)
+
+// HashRing places objects on nodes by consistent hashing. Every node
+// owns VirtualNodes points on the ring, and an object belongs to the
+// first distinct nodes clockwise from its position, so adding or removing
+// a node only moves the objects next to its points.
+type HashRing struct {
+	points []ringPoint
+	nodes  []string
+}
+
+// ringPoint is one virtual node
+type ringPoint struct {
+	hash uint64
+	id   string
+}
+
+// NewHashRing creates a ring of the given nodes with vnodes points each
+func NewHashRing(vnodes int, ids ...string) *HashRing {
+	r := &HashRing{nodes: append([]string(nil), ids...)}
+	sort.Strings(r.nodes)
+
+	for _, id := range r.nodes {
+		for i := range vnodes {
+			hash := sha256.Sum256([]byte(id + "#" + strconv.Itoa(i)))
+			r.points = append(r.points, ringPoint{hash: binary.BigEndian.Uint64(hash[:]), id: id})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].id < r.points[j].id
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	return r
+}
+
+// Nodes returns the nodes on the ring, sorted
+func (r *HashRing) Nodes() []string {
+	return r.nodes
+}
+
+// Owners returns the n nodes an object belongs to in ring order, leaving
+// out skip, or all nodes but skip when there are fewer
+func (r *HashRing) Owners(object kadID, n int, skip string) []string {
+	owners := []string{}
+	if len(r.points) == 0 {
+		return owners
+	}
+
+	pos := binary.BigEndian.Uint64(object[:])
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= pos
+	})
+
+	seen := map[string]bool{skip: true}
+	for i := range r.points {
+		if len(owners) == n {
+			break
+		}
+		id := r.points[(start+i)%len(r.points)].id
+		if !seen[id] {
+			seen[id] = true
+			owners = append(owners, id)
+		}
+	}
+
+	return owners
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/himanshuraimau/drift/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRingOwners(t *testing.T) {
+	nodes := []string{}
+	for i := range 10 {
+		nodes = append(nodes, fmt.Sprintf("node%d", i))
+	}
+	ring := NewHashRing(defaultVirtualNodes, nodes...)
+
+	counts := map[string]int{}
+	for i := range 3000 {
+		object := objectKadID("owner", fmt.Sprintf("key%d", i))
+		owners := ring.Owners(object, 3, "node0")
+		assert.Len(t, owners, 3, "Ring should return the requested number of owners")
+		assert.NotContains(t, owners, "node0", "Skipped node should not own anything")
+		assert.Len(t, slices.Compact(slices.Sorted(slices.Values(owners))), 3, "Owners should be distinct")
+		assert.Equal(t, owners, ring.Owners(object, 3, "node0"), "Placement should be deterministic")
+		for _, id := range owners {
+			counts[id]++
+		}
+	}
+
+	// 9000 replicas over 9 nodes; virtual nodes keep every share near 1000
+	for id, n := range counts {
+		assert.InDelta(t, 1000, n, 400, "Replicas should spread evenly, %s has %d", id, n)
+	}
+
+	assert.Len(t, NewHashRing(defaultVirtualNodes, "a", "b").Owners(objectKadID("o", "k"), 3, ""), 2, "Small rings should return every node")
+}
+
+func TestHashRingMinimalMovement(t *testing.T) {
+	nodes := []string{}
+	for i := range 10 {
+		nodes = append(nodes, fmt.Sprintf("node%d", i))
+	}
+	before := NewHashRing(defaultVirtualNodes, nodes...)
+	after := NewHashRing(defaultVirtualNodes, append(nodes, "node10")...)
+
+	moved := 0
+	for i := range 1000 {
+		object := objectKadID("owner", fmt.Sprintf("key%d", i))
+		prev, next := before.Owners(object, 1, ""), after.Owners(object, 1, "")
+		if prev[0] != next[0] {
+			assert.Equal(t, "node10", next[0], "Objects should only move to the new node")
+			moved++
+		}
+	}
+	assert.InDelta(t, 1000/11, moved, 50, "About a share of the objects should move")
+}
+
+func TestRebalanceOnMemberFailure(t *testing.T) {
+	faults := p2p.NewFaultInjector(1)
+	servers := startCluster(t, 6, faults)
+	s := servers[0]
+	key := "rebalanced"
+	data := []byte("moves when an owner fails")
+
+	assert.NoError(t, s.Store(key, bytes.NewReader(data)), "Store should not error")
+	owners := ringOwners(s, key, servers)
+	assert.NotContains(t, owners, s, "The owner should not be one of its own replicas")
+	assertReplicas(t, s, key, true, owners...)
+
+	// Cut an owner off; once it is dead the ring hands its replica on
+	failed := owners[0]
+	faults.Partition("failed", failed.Transport.Addr())
+	waitForCluster(t, len(servers), func() bool {
+		next := ringOwners(s, key, servers)
+		if slices.Contains(next, failed) || len(next) != defaultReplicationFactor {
+			return false
+		}
+		for _, o := range next {
+			if !o.store.Has(s.ID, s.hashObjectKey(key)) {
+				return false
+			}
+		}
+		return true
+	}, "replica should move to a new owner when an owner fails")
+	assertFetch(t, s, key, data)
+
+	// When it comes back the stand-in owner drops its replica again
+	faults.Heal("failed")
+	waitForCluster(t, len(servers), func() bool {
+		return slices.Equal(ringOwners(s, key, servers), owners) &&
+			len(holders(s, key, servers)) == defaultReplicationFactor
+	}, "replicas should go back to the original owners")
+	assert.ElementsMatch(t, owners, holders(s, key, servers), "Only the original owners should hold a replica")
+}
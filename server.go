@@ -2,11 +2,17 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"sync"
 	"time"
 
@@ -15,22 +21,104 @@ import (
 
 // FileServerOpts contains options for the file server
 type FileServerOpts struct {
+	// ID is the ID this node stores its own objects under. It is the node
+	// ID of IdentityKey, so the ring can leave the owner out of the
+	// replicas of its objects; an ID that differs is rejected.
 	ID                string
 	EncKey            []byte
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
 	Transport         p2p.Transport
 	BootstrapNodes    []string
+
+	// Convergent derives the IV of replicas from a keyed hash of the content
+	// so identical files encrypt identically within a cluster. It lets
+	// replica holders see which objects share content; see README.
+	Convergent bool
+	// KeyHashSecret keys the HMAC that turns object keys into the names
+	// replicas are stored under. When empty it is derived from EncKey.
+	KeyHashSecret []byte
+	// EncryptAtRest keeps the local copy on the originating node in the
+	// same encrypted stream format as replicas, decrypting it in Get
+	EncryptAtRest bool
+	// IdentityKey signs the provenance of objects this node stores and
+	// proves its identity in the handshake. A throwaway key is generated
+	// when it is not set, and ID defaults to the node ID bound to it.
+	IdentityKey ed25519.PrivateKey
+	// ExchangeKey is the X25519 key other nodes encrypt shared files to.
+	// A throwaway key is generated when it is not set.
+	ExchangeKey *ecdh.PrivateKey
+	// ObjectKeys encrypts each object with its own random data key, kept
+	// wrapped under EncKey in this node's keyring, so SecureDelete can
+	// crypto-shred it. Objects cannot be read if the keyring is lost.
+	ObjectKeys bool
+	// Reconnect controls how BootstrapNodes are redialed when they cannot
+	// be reached or the connection drops. Zero values use the defaults.
+	Reconnect ConnManagerOpts
+	// PeerDegree is how many peers a node connects to on its own, picked
+	// from the peers its neighbours tell it about. Zero uses the default
+	// and a negative value turns discovery off.
+	PeerDegree int
+	// PeerExchangeInterval is how often a node shares its peer list with
+	// a random peer. Zero uses the default.
+	PeerExchangeInterval time.Duration
+	// Membership controls how members are probed and declared dead. Zero
+	// values use the defaults.
+	Membership MembershipOpts
+	// ReplicationFactor is how many nodes besides the owner keep a replica
+	// of each object, picked by consistent hashing. Zero uses the default.
+	ReplicationFactor int
+	// VirtualNodes is how many points each node has on the hash ring.
+	// Zero uses the default.
+	VirtualNodes int
+	// DHT controls the Kademlia lookups that find which nodes hold an
+	// object. Zero values use the defaults.
+	DHT DHTOpts
+	// RequestTimeout is how long a node waits for a peer to answer a
+	// request to serve or store a file. Zero uses the default.
+	RequestTimeout time.Duration
+	// WriteConsistency is how many owners must acknowledge writing a
+	// replica before Store returns. Zero uses ConsistencyQuorum.
+	WriteConsistency ConsistencyLevel
+	// ReadConsistency is how many owners Get asks for the version they
+	// hold before fetching the newest. Zero uses ConsistencyQuorum.
+	ReadConsistency ConsistencyLevel
+	// AntiEntropy controls how replicas that missed a store or delete
+	// catch up. Zero values use the defaults.
+	AntiEntropy AntiEntropyOpts
 }
 
+// nodeCapabilities are the optional features a file server advertises in
+// the handshake
+const nodeCapabilities = p2p.CapabilityStore | p2p.CapabilityProvenance
+
 // FileServer represents the distributed file server
 type FileServer struct {
 	FileServerOpts
 
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
+	// peersChanged is closed and replaced whenever a peer connects
+	peersChanged chan struct{}
+	// known are the listen addresses of nodes learned through peer
+	// exchange, by node ID, and dialing the ones being connected to
+	known   map[string]knownPeer
+	dialing map[string]time.Time
+
+	store   *Store
+	keyring *Keyring
+	conns   *ConnManager
+	members *Membership
+	dht     *DHT
+
+	ringLock sync.Mutex
+	ring     *HashRing
+
+	// requests are the file requests waiting for a response, by request ID
+	requestLock sync.Mutex
+	requestID   uint64
+	requests    map[uint64]pendingRequest
 
-	store  *Store
 	quitch chan struct{}
 }
 
@@ -41,184 +129,937 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 		PathTransformFunc: opts.PathTransformFunc,
 	}
 
+	if len(opts.KeyHashSecret) == 0 {
+		secret, err := newKeyHashSecret(opts.EncKey)
+		if err != nil {
+			log.Fatalf("deriving key hash secret: %v", err)
+		}
+		opts.KeyHashSecret = secret
+	}
+	if opts.IdentityKey == nil {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalf("generating identity key: %v", err)
+		}
+		opts.IdentityKey = priv
+	}
+	nodeID := p2p.NodeIDFromKey(opts.IdentityKey.Public().(ed25519.PublicKey))
 	if len(opts.ID) == 0 {
-		opts.ID = generateID()
+		opts.ID = nodeID
+	} else if opts.ID != nodeID {
+		log.Fatalf("ID %s is not the node ID %s of the identity key", opts.ID, nodeID)
+	}
+	if opts.ExchangeKey == nil {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalf("generating exchange key: %v", err)
+		}
+		opts.ExchangeKey = priv
+	}
+
+	if opts.PeerDegree == 0 {
+		opts.PeerDegree = defaultPeerDegree
+	}
+	if opts.PeerExchangeInterval <= 0 {
+		opts.PeerExchangeInterval = defaultPeerExchangeInterval
+	}
+	if opts.ReplicationFactor <= 0 {
+		opts.ReplicationFactor = defaultReplicationFactor
+	}
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = defaultVirtualNodes
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+	if opts.WriteConsistency == 0 {
+		opts.WriteConsistency = ConsistencyQuorum
+	}
+	if opts.ReadConsistency == 0 {
+		opts.ReadConsistency = ConsistencyQuorum
+	}
+	if opts.AntiEntropy.Interval <= 0 {
+		opts.AntiEntropy.Interval = defaultAntiEntropyInterval
+	}
+	if opts.AntiEntropy.TombstoneTTL <= 0 {
+		opts.AntiEntropy.TombstoneTTL = defaultTombstoneTTL
 	}
 
-	return &FileServer{
+	s := &FileServer{
 		FileServerOpts: opts,
 		store:          NewStore(storeOpts),
+		keyring:        NewKeyring(opts.StorageRoot),
+		conns:          NewConnManager(opts.Transport, opts.Reconnect),
+		members:        NewMembership(p2p.NodeIDFromKey(opts.IdentityKey.Public().(ed25519.PublicKey)), opts.Transport.Addr(), opts.Membership),
 		quitch:         make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
+		known:          make(map[string]knownPeer),
+		dialing:        make(map[string]time.Time),
+		peersChanged:   make(chan struct{}),
+		requests:       make(map[uint64]pendingRequest),
 	}
+	s.dht = NewDHT(s.nodeID(), s.isAlive, opts.DHT)
+
+	return s
 }
 
 // Message represents a message sent between peers
 type Message struct {
 	Payload any
+	// Gossip piggybacks membership updates on every message
+	Gossip []MemberUpdate
 }
 
 // MessageStoreFile represents a store file message
 type MessageStoreFile struct {
-	ID   string
-	Key  string
-	Size int64
+	RequestID  uint64
+	ID         string
+	Key        string
+	Size       int64
+	Provenance Provenance
+	// StreamID is the stream the replica is written to
+	StreamID uint32
 }
 
 // MessageGetFile represents a get file message
 type MessageGetFile struct {
-	ID  string
-	Key string
+	RequestID uint64
+	ID        string
+	Key       string
+	// StreamID is the stream the file is to be served on
+	StreamID uint32
 }
 
-// MessageDeleteFile represents a delete file message
+// MessageDeleteFile represents a delete file message. It carries the
+// tombstone the owner signed, which every replica checks and records.
 type MessageDeleteFile struct {
-	ID  string
-	Key string
+	Tombstone Tombstone
+}
+
+// nodeID returns the node ID bound to this node's identity key
+func (s *FileServer) nodeID() string {
+	return p2p.NodeIDFromKey(s.IdentityKey.Public().(ed25519.PublicKey))
 }
 
-// broadcast sends a message to all connected peers
-func (s *FileServer) broadcast(msg *Message) error {
+// hashObjectKey returns the name a key is stored under on other peers
+func (s *FileServer) hashObjectKey(key string) string {
+	return hmacKey(s.KeyHashSecret, key)
+}
+
+// objectName returns the name the replicas of a stored key are under: the
+// one its local copy was signed for, which is the legacy unkeyed hash for
+// objects stored before keyed hashing, or the keyed hash
+func (s *FileServer) objectName(key string) string {
+	if meta, err := s.store.ReadMeta(s.ID, key); err == nil && meta.Provenance != nil {
+		return meta.Provenance.Key
+	}
+	return s.hashObjectKey(key)
+}
+
+// servedMeta returns the metadata of an object peers may be served: a
+// replica, or a shared object, stored under the name its provenance was
+// signed for. The local copies of this node's files are stored under
+// their key instead and are never served, nor is their existence told.
+func (s *FileServer) servedMeta(id string, key string) (ObjectMeta, bool) {
+	if !s.store.Has(id, key) {
+		return ObjectMeta{}, false
+	}
+
+	meta, err := s.store.ReadMeta(id, key)
+	if err != nil || meta.Provenance == nil || meta.Provenance.Key != key {
+		return ObjectMeta{}, false
+	}
+	return meta, true
+}
+
+// send sends a message to a single peer
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	msg.Gossip = append(msg.Gossip, s.members.Gossip()...)
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
 		return err
 	}
 
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return peer.Send(buf.Bytes())
 }
 
 // Get retrieves a file from the network
 func (s *FileServer) Get(key string) (io.Reader, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext retrieves a file from the network, giving up when ctx is
+// done. The deadline of ctx applies to every transfer from a peer.
+func (s *FileServer) GetContext(ctx context.Context, key string) (io.Reader, error) {
 	if s.store.Has(s.ID, key) {
-		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
-		_, r, err := s.store.Read(s.ID, key)
-		return r, err
+		r, err := s.readLocal(key)
+		if !errors.Is(err, ErrInvalidProvenance) {
+			fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
+			return r, err
+		}
+		log.Printf("[%s] local copy of (%s) failed verification, fetching it again: %v", s.Transport.Addr(), key, err)
 	}
 
 	fmt.Printf("[%s] don't have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
 
-	msg := Message{
-		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: hashKey(key),
-		},
+	author := s.IdentityKey.Public().(ed25519.PublicKey)
+	data, prov, err := s.fetch(ctx, s.ID, s.hashObjectKey(key), author)
+	if err != nil && ctx.Err() == nil {
+		// Objects stored before keyed hashing are under the legacy name
+		var legacyErr error
+		if data, prov, legacyErr = s.fetch(ctx, s.ID, hashKey(key), author); legacyErr == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	local := data
+	if !s.EncryptAtRest {
+		encKey, err := s.dataKey(prov.Key)
+		if err != nil {
+			return nil, err
+		}
+		plain := new(bytes.Buffer)
+		if _, err := copyDecrypt(encKey, bytes.NewReader(data), plain); err != nil {
+			return nil, err
+		}
+		local = plain.Bytes()
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	if err := s.writeLocal(key, local, prov); err != nil {
 		return nil, err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	return s.readLocal(key)
+}
 
-	for _, peer := range s.peers {
-		// Read the file size first
-		var fileSize int64
-		if err := binary.Read(peer, binary.LittleEndian, &fileSize); err != nil {
+// GetShared retrieves a file another node shared with this one and
+// decrypts it with this node's exchange key
+func (s *FileServer) GetShared(ref ShareRef) (io.Reader, error) {
+	return s.GetSharedContext(context.Background(), ref)
+}
+
+// GetSharedContext is GetShared giving up when ctx is done
+func (s *FileServer) GetSharedContext(ctx context.Context, ref ShareRef) (io.Reader, error) {
+	if s.store.Has(ref.Owner, ref.Key) {
+		r, err := s.readShared(ref)
+		if !errors.Is(err, ErrInvalidProvenance) {
+			return r, err
+		}
+		log.Printf("[%s] local copy of (%s) failed verification, fetching it again: %v", s.Transport.Addr(), ref.Key, err)
+	}
+
+	data, prov, err := s.fetch(ctx, ref.Owner, ref.Key, ref.Author)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.store.Write(ref.Owner, ref.Key, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if err := s.store.WriteMeta(ref.Owner, ref.Key, ObjectMeta{Provenance: prov}); err != nil {
+		return nil, err
+	}
+
+	return s.readShared(ref)
+}
+
+// readShared opens the local copy of a shared file once it matches the
+// provenance of its author, and decrypts it with this node's exchange key
+func (s *FileServer) readShared(ref ShareRef) (io.Reader, error) {
+	_, r, err := s.store.Read(ref.Owner, ref.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := s.store.ReadMeta(ref.Owner, ref.Key)
+	if err == nil {
+		err = verifyCopy(r, meta.Provenance, ref.Author, ref.Key)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	dr, err := openShare(s.ExchangeKey, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return readCloser{Reader: dr, Closer: r}, nil
+}
+
+// fetch asks the owners of the object stored under id and name which
+// version they hold, as many as ReadConsistency needs, and returns the
+// newest one signed by author. Owners found holding a missing or older
+// copy are repaired in the background.
+func (s *FileServer) fetch(ctx context.Context, id string, name string, author ed25519.PublicKey) ([]byte, *Provenance, error) {
+	owners := s.owners(id, name)
+	versions, err := s.readVersions(ctx, s.connectAll(ctx, owners), s.ReadConsistency.required(len(owners)), id, name, author)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if newest := newestVersion(versions); newest != nil {
+		data, prov, err := s.fetchFrom(ctx, holding(versions, newest), id, name, author)
+		if err == nil && !bytes.Equal(prov.Hash, newest.Hash) {
+			err = fmt.Errorf("file (%s) changed while it was fetched", name)
+		}
+		if err == nil {
+			go s.repair(id, *prov, data, stale(versions, prov))
+			return data, prov, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Owners that joined recently may not have the object yet
+	tried := map[string]bool{}
+	for _, c := range owners {
+		tried[c.ID] = true
+	}
+	providers := []Contact{}
+	for _, c := range s.findProviders(ctx, id, name) {
+		if !tried[c.ID] {
+			providers = append(providers, c)
+		}
+	}
+
+	return s.fetchFrom(ctx, s.connectAll(ctx, providers), id, name, author)
+}
+
+// fetchFrom requests an object from the given peers and returns the
+// first copy whose provenance checks out. Peers answer whether they have
+// it before sending anything, so it only waits for the peers that do.
+func (s *FileServer) fetchFrom(ctx context.Context, peers []p2p.Peer, id string, name string, author ed25519.PublicKey) ([]byte, *Provenance, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(peers) == 0 {
+		return nil, nil, fmt.Errorf("file (%s) could not be fetched from the network", name)
+	}
+
+	type request struct {
+		peer   p2p.Peer
+		stream *p2p.Stream
+	}
+
+	// Every peer answers on its own stream, so responses cannot mix
+	responses := make(chan MessageResponse, len(peers))
+	requests := make(map[uint64]request)
+	defer func() {
+		for reqID, req := range requests {
+			s.forgetResponse(reqID)
+			req.stream.Reset()
+		}
+	}()
+
+	for _, peer := range peers {
+		stream, err := peer.OpenStream()
+		if err != nil {
+			log.Printf("[%s] requesting file (%s) from (%s): %v", s.Transport.Addr(), name, p2p.PeerID(peer), err)
 			continue
 		}
+		if deadline, ok := ctx.Deadline(); ok {
+			stream.SetDeadline(deadline)
+		}
 
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
+		reqID := s.expectResponse(peer, responses)
+		msg := Message{
+			Payload: MessageGetFile{
+				RequestID: reqID,
+				ID:        id,
+				Key:       name,
+				StreamID:  stream.ID(),
+			},
+		}
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("[%s] requesting file (%s) from (%s): %v", s.Transport.Addr(), name, p2p.PeerID(peer), err)
+			s.forgetResponse(reqID)
+			stream.Reset()
+			continue
+		}
+		requests[reqID] = request{peer: peer, stream: stream}
+	}
+
+	timer := time.NewTimer(s.RequestTimeout)
+	defer timer.Stop()
+
+	for answered := 0; answered < len(requests); {
+		var resp MessageResponse
+		select {
+		case resp = <-responses:
+		case <-timer.C:
+			return nil, nil, fmt.Errorf("file (%s) could not be fetched from the network: no response within %s", name, s.RequestTimeout)
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-s.quitch:
+			return nil, nil, errServerStopped
+		}
+
+		// A request whose send failed can still be failed by the disconnect
+		req, ok := requests[resp.RequestID]
+		if !ok {
+			continue
+		}
+		answered++
+
+		peer, stream := req.peer, req.stream
+		if err := resp.Err(); err != nil {
+			if resp.Status != StatusNotFound {
+				log.Printf("[%s] requesting file (%s) from (%s): %v", s.Transport.Addr(), name, p2p.PeerID(peer), err)
+			}
+			continue
+		}
+
+		prov, buf, err := readReplica(ctx, stream, resp.Size)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
 		if err != nil {
-			return nil, err
+			// A broken transfer is no reason to give up on the other peers
+			log.Printf("[%s] reading file (%s) from (%s): %v", s.Transport.Addr(), name, peer.RemoteAddr(), err)
+			continue
+		}
+
+		n := int64(buf.Len())
+		hash := sha256.Sum256(buf.Bytes())
+		if err := verifyAuthor(prov, author, name, n, hash[:]); err != nil {
+			log.Printf("[%s] rejecting file (%s) from (%s): %v", s.Transport.Addr(), name, peer.RemoteAddr(), err)
+			continue
 		}
 
 		fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
 
-		peer.CloseStream()
-		break
+		stream.Close()
+		return buf.Bytes(), prov, nil
 	}
 
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
+	return nil, nil, fmt.Errorf("file (%s) could not be fetched from the network", name)
+}
+
+// readReplica reads the provenance and size bytes of data a peer serves
+// on a stream, aborting the transfer when ctx is done
+func readReplica(ctx context.Context, stream *p2p.Stream, size int64) (*Provenance, *bytes.Buffer, error) {
+	stop := context.AfterFunc(ctx, func() { stream.Reset() })
+	defer stop()
+
+	prov, err := readProvenance(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, io.LimitReader(stream, size)); err != nil {
+		return nil, nil, err
+	}
+
+	return prov, buf, nil
 }
 
 // Store stores a file in the distributed network
 func (s *FileServer) Store(key string, r io.Reader) error {
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
+	return s.StoreContext(context.Background(), key, r)
+}
+
+// StoreContext is Store, giving up on the replicas not written when ctx
+// is done. The local copy is kept either way.
+func (s *FileServer) StoreContext(ctx context.Context, key string, r io.Reader) error {
+	fileBuffer := new(bytes.Buffer)
+	if _, err := io.Copy(fileBuffer, r); err != nil {
+		return err
+	}
+
+	name := s.hashObjectKey(key)
+	// A version stored under the legacy name is replaced by this one
+	var previous string
+	if s.store.Has(s.ID, key) {
+		previous = s.objectName(key)
+	}
+
+	encKey, err := s.newDataKey(name)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt once so replicas and an at-rest local copy share one stream
+	replica := new(bytes.Buffer)
+	if _, err := s.encryptReplica(encKey, fileBuffer.Bytes(), replica); err != nil {
+		return err
+	}
+
+	local := fileBuffer.Bytes()
+	if s.EncryptAtRest {
+		local = replica.Bytes()
+	}
+
+	prov := newProvenance(s.IdentityKey, name, replica.Bytes())
+	if err := s.writeLocal(key, local, &prov); err != nil {
+		return err
+	}
+
+	if len(previous) > 0 && previous != name {
+		if err := s.deleteReplicas(ctx, previous, false); err != nil {
+			log.Printf("[%s] deleting replicas of (%s) under its legacy name: %v", s.Transport.Addr(), key, err)
+		}
+	}
+
+	return s.distribute(ctx, prov, replica.Bytes())
+}
+
+// StoreFor stores a file that only the given recipients, and this node,
+// can decrypt. Other peers hold ciphertext they cannot open.
+func (s *FileServer) StoreFor(key string, r io.Reader, recipients ...*ecdh.PublicKey) (ShareRef, error) {
+	return s.StoreForContext(context.Background(), key, r, recipients...)
+}
+
+// StoreForContext is StoreFor, giving up on the replicas not written when
+// ctx is done
+func (s *FileServer) StoreForContext(ctx context.Context, key string, r io.Reader, recipients ...*ecdh.PublicKey) (ShareRef, error) {
+	recipients = append(recipients, s.ExchangeKey.PublicKey())
+
+	stream := new(bytes.Buffer)
+	if err := sealShare(recipients, r, stream); err != nil {
+		return ShareRef{}, err
+	}
+
+	ref := ShareRef{
+		Owner:  s.ID,
+		Key:    s.hashObjectKey(sharedKeyPrefix + key),
+		Author: s.IdentityKey.Public().(ed25519.PublicKey),
+	}
+
+	if _, err := s.store.Write(ref.Owner, ref.Key, bytes.NewReader(stream.Bytes())); err != nil {
+		return ShareRef{}, err
+	}
+
+	prov := newProvenance(s.IdentityKey, ref.Key, stream.Bytes())
+	if err := s.store.WriteMeta(ref.Owner, ref.Key, ObjectMeta{Provenance: &prov}); err != nil {
+		return ShareRef{}, err
+	}
+
+	return ref, s.distribute(ctx, prov, stream.Bytes())
+}
+
+// replicate streams a signed replica of an object to each target in
+// parallel and returns the ones that wrote it
+func (s *FileServer) replicate(ctx context.Context, owner string, prov Provenance, data []byte, targets []Contact) []Contact {
+	holders := []Contact{}
+	for holder := range s.replicas(ctx, owner, prov, data, targets) {
+		holders = append(holders, holder)
+	}
+	return holders
+}
 
-	size, err := s.store.Write(s.ID, key, tee)
+// replicas streams a signed replica of an object to each target in
+// parallel. Every target that acknowledges writing it is sent on the
+// returned channel, which is closed once all of them are done.
+func (s *FileServer) replicas(ctx context.Context, owner string, prov Provenance, data []byte, targets []Contact) <-chan Contact {
+	peers := s.connectAll(ctx, targets)
+	holders := make(chan Contact, len(peers))
+
+	// Replicas are sent separately so a failing peer only loses its own
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// A peer with a newer version does not hold this one, so it
+			// is no acknowledgement either
+			if err := s.sendReplica(ctx, peer, owner, prov, data); err != nil {
+				log.Printf("[%s] replicating to (%s): %v", s.Transport.Addr(), p2p.PeerID(peer), err)
+				return
+			}
+			holders <- Contact{ID: p2p.PeerID(peer), Addr: listenAddr(peer)}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(holders)
+	}()
+
+	return holders
+}
+
+// sendReplica streams a replica to a peer and waits until the peer
+// reports it written
+func (s *FileServer) sendReplica(ctx context.Context, peer p2p.Peer, owner string, prov Provenance, data []byte) error {
+	stream, err := peer.OpenStream()
 	if err != nil {
 		return err
 	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	response := make(chan MessageResponse, 1)
+	reqID := s.expectResponse(peer, response)
 
 	msg := Message{
 		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  hashKey(key),
-			Size: size + 16, // Add 16 bytes for IV
+			RequestID:  reqID,
+			ID:         owner,
+			Key:        prov.Key,
+			Size:       prov.Size,
+			Provenance: prov,
+			StreamID:   stream.ID(),
 		},
 	}
+	if err := s.send(peer, &msg); err != nil {
+		s.forgetResponse(reqID)
+		stream.Reset()
+		return err
+	}
+
+	// A peer that refuses the replica resets the stream, failing the
+	// write, and still answers why
+	stop := context.AfterFunc(ctx, func() { stream.Reset() })
+	_, writeErr := stream.Write(data)
+	stop()
+	if writeErr != nil {
+		stream.Reset()
+		if ctx.Err() != nil {
+			s.forgetResponse(reqID)
+			return ctx.Err()
+		}
+	} else {
+		stream.Close()
+	}
 
-	if err := s.broadcast(&msg); err != nil {
+	resp, err := s.awaitResponse(ctx, reqID, response)
+	if err != nil {
 		return err
 	}
+	if err := resp.Err(); err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if resp.Size != prov.Size {
+		return fmt.Errorf("peer wrote %d of %d bytes", resp.Size, prov.Size)
+	}
+	if !bytes.Equal(resp.Checksum, prov.Hash) {
+		return fmt.Errorf("peer wrote a replica with checksum %x, not %x", resp.Checksum, prov.Hash)
+	}
 
-	time.Sleep(time.Millisecond * 5)
+	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), resp.Size)
 
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+	return nil
+}
+
+// distribute replicates a new object of this node to its owners on the
+// ring and records where it is in the DHT. It returns once as many owners
+// as WriteConsistency asks for acknowledged the replica; the others are
+// still sent it, and announced, after it returns. It reports ctx's error
+// if ctx ended first.
+func (s *FileServer) distribute(ctx context.Context, prov Provenance, data []byte) error {
+	targets := s.owners(s.ID, prov.Key)
+	required := s.WriteConsistency.required(len(targets))
+
+	// Replicas still in flight once the level is reached outlive ctx
+	replicaCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	detach := context.AfterFunc(ctx, cancel)
+
+	replicas := s.replicas(replicaCtx, s.ID, prov, data, targets)
+	holders := []Contact{s.self()}
+	for len(holders) <= required {
+		holder, ok := <-replicas
+		if !ok {
+			break
+		}
+		holders = append(holders, holder)
 	}
 
-	if len(peers) > 0 {
-		mw := io.MultiWriter(peers...)
-		mw.Write([]byte{p2p.IncomingStream})
-		n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
-		if err != nil {
+	acked := len(holders) - 1
+	if acked < required {
+		cancel()
+		s.announce(ctx, s.ID, prov.Key, holders)
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-
-		fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
+		return fmt.Errorf("%w: %d of %d owners wrote (%s), %s needs %d", ErrWriteConsistency, acked, len(targets), prov.Key, s.WriteConsistency, required)
 	}
 
+	detach()
+	s.announce(ctx, s.ID, prov.Key, holders)
+	go func() {
+		defer cancel()
+
+		late := []Contact{}
+		for holder := range replicas {
+			late = append(late, holder)
+		}
+		if len(late) > 0 {
+			s.announce(replicaCtx, s.ID, prov.Key, late)
+		}
+	}()
+
 	return nil
 }
 
+// encryptReplica encrypts a file into the replica stream format
+func (s *FileServer) encryptReplica(encKey []byte, data []byte, w io.Writer) (int, error) {
+	if s.Convergent {
+		return copyEncryptConvergent(encKey, data, w)
+	}
+	return copyEncrypt(encKey, bytes.NewReader(data), w)
+}
+
+// newDataKey returns the key a new version of the named object is
+// encrypted with, generating and recording a fresh one with ObjectKeys
+func (s *FileServer) newDataKey(name string) ([]byte, error) {
+	if !s.ObjectKeys {
+		return s.EncKey, nil
+	}
+
+	dataKey := newEncryptionKey()
+	sealed, err := sealKey(s.EncKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return dataKey, s.keyring.WriteDataKey(name, sealed)
+}
+
+// dataKey returns the key the named object is encrypted with
+func (s *FileServer) dataKey(name string) ([]byte, error) {
+	if !s.ObjectKeys {
+		return s.EncKey, nil
+	}
+
+	sealed, err := s.keyring.DataKey(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return openKey(s.EncKey, sealed)
+}
+
+// writeLocal stores the local copy of a file with the provenance of its
+// replicas and this node's signature of the copy itself, which is
+// decrypted unless it is encrypted at rest. The copy is signed for the
+// hashed name of its replicas, so its key is not written to disk.
+func (s *FileServer) writeLocal(key string, local []byte, prov *Provenance) error {
+	if _, err := s.store.Write(s.ID, key, bytes.NewReader(local)); err != nil {
+		return err
+	}
+
+	signed := newProvenance(s.IdentityKey, prov.Key, local)
+	return s.store.WriteMeta(s.ID, key, ObjectMeta{Provenance: prov, Local: &signed})
+}
+
+// readLocal opens the local copy of a file once it matches the signature
+// this node made when storing it, decrypting it when it is encrypted at
+// rest
+func (s *FileServer) readLocal(key string) (io.Reader, error) {
+	_, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := s.store.ReadMeta(s.ID, key)
+	if err == nil && meta.Provenance == nil {
+		err = fmt.Errorf("%w: local copy has no provenance", ErrInvalidProvenance)
+	}
+	if err == nil {
+		err = verifyCopy(r, meta.Local, s.IdentityKey.Public().(ed25519.PublicKey), meta.Provenance.Key)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	if !s.EncryptAtRest {
+		return r, nil
+	}
+
+	encKey, err := s.dataKey(s.objectName(key))
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	dr, err := newDecryptReader(encKey, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return readCloser{Reader: dr, Closer: r}, nil
+}
+
 // Delete removes a file from the distributed network
 func (s *FileServer) Delete(key string) error {
+	return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete, leaving the file untouched if ctx is done
+// before the nodes holding it are found
+func (s *FileServer) DeleteContext(ctx context.Context, key string) error {
+	return s.delete(ctx, key, false)
+}
+
+// SecureDelete removes a file from the distributed network, overwriting
+// every copy before unlinking it. With ObjectKeys the object's data key
+// is destroyed as well, so replicas that miss the delete stay unreadable.
+func (s *FileServer) SecureDelete(key string) error {
+	return s.SecureDeleteContext(context.Background(), key)
+}
+
+// SecureDeleteContext is SecureDelete, leaving the file untouched if ctx
+// is done before the nodes holding it are found
+func (s *FileServer) SecureDeleteContext(ctx context.Context, key string) error {
+	return s.delete(ctx, key, true)
+}
+
+// delete removes a file locally and from its owners and the nodes that
+// hold it or keep its provider records
+func (s *FileServer) delete(ctx context.Context, key string, secure bool) error {
 	if !s.store.Has(s.ID, key) {
 		return fmt.Errorf("file (%s) does not exist", key)
 	}
 
-	msg := Message{
-		Payload: MessageDeleteFile{
-			ID:  s.ID,
-			Key: hashKey(key),
-		},
+	if err := s.deleteReplicas(ctx, s.objectName(key), secure); err != nil {
+		return err
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	if secure {
+		return s.store.SecureDelete(s.ID, key)
+	}
+	return s.store.Delete(s.ID, key)
+}
+
+// deleteReplicas removes the replicas of an object from its owners and
+// the nodes that hold it or keep its provider records, and forgets its
+// data key
+func (s *FileServer) deleteReplicas(ctx context.Context, name string, secure bool) error {
+	object := objectKadID(s.ID, name)
+	// The provider lookup stops early; the records are on the closest nodes
+	closest, _ := s.lookup(ctx, object, nil)
+	_, providers := s.lookup(ctx, object, &MessageFindValue{Owner: s.ID, Key: name})
+	// A partial lookup would leave copies behind
+	if err := ctx.Err(); err != nil {
 		return err
 	}
+	s.dht.RemoveProviders(object)
 
-	return s.store.Delete(s.ID, key)
+	tombstone := newTombstone(s.IdentityKey, name, secure)
+	targets := append(s.owners(s.ID, name), closest...)
+	s.sendContacts(ctx, append(targets, providers...), func() *Message {
+		return &Message{Payload: MessageDeleteFile{Tombstone: tombstone}}
+	})
+
+	if s.ObjectKeys {
+		if err := s.keyring.DeleteDataKey(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Stop stops the file server
 func (s *FileServer) Stop() {
+	s.conns.Stop()
 	close(s.quitch)
 }
 
+// Connections returns the state of the connection to every bootstrap node
+func (s *FileServer) Connections() []ConnStatus {
+	return s.conns.Statuses()
+}
+
 // OnPeer handles new peer connections
 func (s *FileServer) OnPeer(p p2p.Peer) error {
+	id := p2p.PeerID(p)
+
+	s.peerLock.Lock()
+	existing, ok := s.peers[id]
+	if ok && existing != p {
+		if !s.preferConn(p, existing) {
+			s.peerLock.Unlock()
+			return fmt.Errorf("already connected to %s", id)
+		}
+		defer existing.Close()
+	}
+	s.peers[id] = p
+	close(s.peersChanged)
+	s.peersChanged = make(chan struct{})
+	delete(s.dialing, listenAddr(p))
+	s.conns.Connected(p)
+	s.members.Join(id, listenAddr(p))
+	s.dht.Update(Contact{ID: id, Addr: listenAddr(p)})
+	s.peerLock.Unlock()
+
+	log.Printf("connected with remote %s (%s)", p.RemoteAddr(), id)
+
+	// Sending waits for the peer's read loop, which starts after its OnPeer
+	go func() {
+		s.sendMembers(p)
+		s.sendPeerExchange(p)
+	}()
+
+	return nil
+}
+
+// preferConn reports whether conn should replace existing as the
+// connection to the same node. Both ends keep the connection dialed by
+// the node with the lower node ID, so they agree which of two crossing
+// dials to drop.
+func (s *FileServer) preferConn(conn, existing p2p.Peer) bool {
+	dialer := func(p p2p.Peer) string {
+		if p.Outbound() {
+			return s.nodeID()
+		}
+		return p2p.PeerID(p)
+	}
+
+	return dialer(conn) < dialer(existing)
+}
+
+// OnPeerDisconnect removes a peer whose connection is gone
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer, err error) {
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
-	s.peers[p.RemoteAddr().String()] = p
+	// The node may already be connected again over a newer connection
+	id := p2p.PeerID(p)
+	if s.peers[id] == p {
+		delete(s.peers, id)
+		s.members.Leave(id)
+	}
+	s.conns.Disconnected(p, err)
+	s.failRequests(p, fmt.Errorf("disconnected: %v", err))
 
-	log.Printf("connected with remote %s", p.RemoteAddr())
+	log.Printf("disconnected from remote %s (%s): %v", p.RemoteAddr(), id, err)
+}
 
-	return nil
+// peer returns the connected peer with the given ID
+func (s *FileServer) peer(id string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[id]
+	return peer, ok
+}
+
+// peerList returns a snapshot of the connected peers
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
 }
 
 // loop is the main event loop for the file server
@@ -248,102 +1089,226 @@ func (s *FileServer) loop() {
 
 // handleMessage handles incoming messages from peers
 func (s *FileServer) handleMessage(from string, msg *Message) error {
+	s.applyGossip(msg.Gossip)
+
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
 		return s.handleMessageStoreFile(from, v)
 	case MessageGetFile:
 		return s.handleMessageGetFile(from, v)
+	case MessageGetMeta:
+		return s.handleMessageGetMeta(from, v)
+	case MessageSyncTree:
+		return s.handleMessageSyncTree(from, v)
 	case MessageDeleteFile:
 		return s.handleMessageDeleteFile(from, v)
+	case MessagePeerExchange:
+		return s.handleMessagePeerExchange(from, v)
+	case MessageMembers:
+		return s.handleMessageMembers(from, v)
+	case MessagePing:
+		return s.handleMessagePing(from, v)
+	case MessagePingReq:
+		return s.handleMessagePingReq(from, v)
+	case MessageAck:
+		return s.handleMessageAck(from, v)
+	case MessageFindNode:
+		return s.handleMessageFindNode(from, v)
+	case MessageFindValue:
+		return s.handleMessageFindValue(from, v)
+	case MessageNodes:
+		return s.handleMessageNodes(from, v)
+	case MessageAddProvider:
+		return s.handleMessageAddProvider(from, v)
+	case MessageResponse:
+		return s.handleMessageResponse(from, v)
 	}
 
 	return nil
 }
 
-// handleMessageGetFile handles get file requests
+// handleMessageGetFile handles get file requests. It answers whether it
+// has the file, then sends it on the requested stream without holding up
+// other messages.
 func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
 	}
 
-	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
-
-	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
+	stream, err := peer.AcceptStream(msg.StreamID)
 	if err != nil {
+		s.sendResponse(peer, msg.RequestID, 0, err)
 		return err
 	}
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		defer rc.Close()
-	}
-
-	peer, ok := s.peers[from]
+	meta, ok := s.servedMeta(msg.ID, msg.Key)
 	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+		stream.Close()
+		return s.send(peer, &Message{
+			Payload: MessageResponse{RequestID: msg.RequestID, Status: StatusNotFound},
+		})
 	}
 
-	// Send the incoming stream indicator and file size
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
+	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
+
+	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
 	if err != nil {
+		stream.Reset()
+		s.sendResponse(peer, msg.RequestID, 0, err)
+		return err
+	}
+
+	if err := s.sendResponse(peer, msg.RequestID, fileSize, nil); err != nil {
+		r.Close()
+		stream.Reset()
 		return err
 	}
 
-	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	go func() {
+		defer r.Close()
+		defer stream.Close()
+
+		// Send the provenance ahead of the data
+		if err := writeProvenance(stream, meta.Provenance); err != nil {
+			log.Printf("[%s] serving file (%s): %v", s.Transport.Addr(), msg.Key, err)
+			return
+		}
+		n, err := io.Copy(stream, r)
+		if err != nil {
+			log.Printf("[%s] serving file (%s): %v", s.Transport.Addr(), msg.Key, err)
+			return
+		}
+
+		fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	}()
 
 	return nil
 }
 
-// handleMessageStoreFile handles store file requests
+// handleMessageStoreFile handles store file requests. The replica is
+// received without holding up other messages, and the sender is told
+// once it is written.
 func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
 	}
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	stream, err := peer.AcceptStream(msg.StreamID)
 	if err != nil {
+		s.sendResponse(peer, msg.RequestID, 0, err)
 		return err
 	}
 
-	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+	go func() {
+		n, sum, err := s.receiveReplica(stream, msg)
+		if err != nil {
+			log.Printf("[%s] storing file (%s): %v", s.Transport.Addr(), msg.Key, err)
+		}
 
-	peer.CloseStream()
+		// The ack tells the sender what was written, not what was sent
+		resp := newResponse(msg.RequestID, n, err)
+		resp.Checksum = sum
+		if err := s.send(peer, &Message{Payload: resp}); err != nil {
+			log.Printf("[%s] answering store of (%s): %v", s.Transport.Addr(), msg.Key, err)
+		}
+	}()
 
 	return nil
 }
 
+// receiveReplica writes a replica read from a stream and checks it
+// against its provenance. It returns the size and checksum of what it
+// wrote.
+func (s *FileServer) receiveReplica(stream *p2p.Stream, msg MessageStoreFile) (int64, []byte, error) {
+	n, sum, err := s.storeReplica(msg.ID, msg.Key, msg.Provenance, io.LimitReader(stream, msg.Size))
+	if err != nil {
+		stream.Reset()
+		return n, sum, err
+	}
+	stream.Close()
+
+	return n, sum, nil
+}
+
+// storeReplica writes a replica and checks it against its provenance. It
+// returns the size and checksum of what it wrote.
+func (s *FileServer) storeReplica(id string, key string, prov Provenance, r io.Reader) (int64, []byte, error) {
+	// Only the owner may write the objects stored under its ID
+	if err := prov.VerifyOwner(id); err != nil {
+		return 0, nil, err
+	}
+
+	// Older versions, from a handoff or repair that raced a store or
+	// delete, must not overwrite the newer one
+	if s.superseded(id, key, prov.Timestamp) {
+		return 0, nil, errSuperseded
+	}
+
+	hash := sha256.New()
+	n, err := s.store.Write(id, key, io.TeeReader(r, hash))
+	if err != nil {
+		return n, nil, err
+	}
+
+	sum := hash.Sum(nil)
+	if err := prov.VerifyContent(key, n, sum); err != nil {
+		s.store.Delete(id, key)
+		return n, sum, err
+	}
+
+	if err := s.store.WriteMeta(id, key, ObjectMeta{Provenance: &prov}); err != nil {
+		return n, sum, err
+	}
+	// The object was deleted before this version was stored
+	if err := s.store.DeleteTombstone(id, key); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return n, sum, err
+	}
+
+	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+
+	return n, sum, nil
+}
+
 // handleMessageDeleteFile handles delete file requests
 func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
-	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("file (%s) does not exist", msg.Key)
-	}
+	t := msg.Tombstone
 
-	if err := s.store.Delete(msg.ID, msg.Key); err != nil {
+	// The tombstone is kept even without a replica, for anti-entropy
+	deleted, err := s.applyTombstone(t)
+	if err != nil {
 		return err
 	}
+	s.dht.RemoveProviders(objectKadID(t.ID, t.Key))
+	if !deleted {
+		return nil
+	}
 
-	fmt.Printf("[%s] deleted file (%s)\n", s.Transport.Addr(), msg.Key)
+	fmt.Printf("[%s] deleted file (%s)\n", s.Transport.Addr(), t.Key)
 
 	return nil
 }
 
-// bootstrapNetwork connects to bootstrap nodes
+// bootstrapNetwork connects to bootstrap nodes and keeps them connected,
+// then discovers more peers through peer exchange
 func (s *FileServer) bootstrapNetwork() error {
 	for _, addr := range s.BootstrapNodes {
 		if len(addr) == 0 {
 			continue
 		}
 
-		go func(addr string) {
-			fmt.Printf("[%s] attempting to connect with remote %s\n", s.Transport.Addr(), addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("dial error: ", err)
-			}
-		}(addr)
+		fmt.Printf("[%s] attempting to connect with remote %s\n", s.Transport.Addr(), addr)
+		s.conns.Add(addr)
 	}
 
+	s.conns.Start()
+
+	go s.peerExchangeLoop()
+	go s.probeLoop()
+	go s.rebalanceLoop()
+	go s.antiEntropyLoop()
+
 	return nil
 }
 
@@ -367,4 +1332,16 @@ func init() {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
 	gob.Register(MessageDeleteFile{})
+	gob.Register(MessagePeerExchange{})
+	gob.Register(MessageMembers{})
+	gob.Register(MessagePing{})
+	gob.Register(MessagePingReq{})
+	gob.Register(MessageAck{})
+	gob.Register(MessageFindNode{})
+	gob.Register(MessageFindValue{})
+	gob.Register(MessageNodes{})
+	gob.Register(MessageAddProvider{})
+	gob.Register(MessageResponse{})
+	gob.Register(MessageGetMeta{})
+	gob.Register(MessageSyncTree{})
 }
\ No newline at end of file
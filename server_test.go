@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// newMemoryServer creates a file server on an in-memory network, stored
+// under a test directory removed when the test ends. Its connections
+// suffer the faults of f unless f is nil.
+func newMemoryServer(t *testing.T, network *p2p.MemoryNetwork, f *p2p.FaultInjector, addr string, nodes ...string) *FileServer {
+	_, identityKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err, "Generating identity key should not error")
+
+	transport := p2p.NewMemoryTransport(network, p2p.TCPTransportOpts{
+		ListenAddr: addr,
+		HandshakeFunc: p2p.NewIdentityHandshake(p2p.HandshakeConfig{
+			PrivateKey:   identityKey,
+			ListenAddr:   addr,
+			Capabilities: nodeCapabilities,
+		}),
+		Decoder: p2p.DefaultDecoder{},
+	})
+	var tr p2p.Transport = transport
+	var faulty *p2p.FaultyTransport
+	if f != nil {
+		faulty = p2p.NewFaultyTransport(transport, f)
+		tr = faulty
+	}
+
+	// A stopped server can still be finishing a handoff, so servers of
+	// earlier tests or test runs must not share its storage root
+	root, err := os.MkdirTemp("", "drift_test_"+addr+"_")
+	assert.NoError(t, err, "Creating a storage root should not error")
+
+	s := NewFileServer(FileServerOpts{
+		EncKey:            newEncryptionKey(),
+		IdentityKey:       identityKey,
+		StorageRoot:       root,
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         tr,
+		BootstrapNodes:    nodes,
+		// Probes leave enough slack that a member slowed down by the race
+		// detector is not taken for dead
+		Membership: MembershipOpts{
+			ProbeInterval:    200 * time.Millisecond,
+			ProbeTimeout:     100 * time.Millisecond,
+			SuspicionTimeout: time.Second,
+		},
+		DHT:            DHTOpts{QueryTimeout: 500 * time.Millisecond},
+		RequestTimeout: time.Second,
+		AntiEntropy:    AntiEntropyOpts{Interval: 200 * time.Millisecond},
+		// A healed partition should not wait out a long backoff
+		Reconnect: ConnManagerOpts{MaxBackoff: time.Second},
+	})
+	transport.OnPeer = s.OnPeer
+	transport.OnPeerDisconnect = s.OnPeerDisconnect
+	if faulty != nil {
+		transport.OnPeer = faulty.WrapOnPeer(s.OnPeer)
+		transport.OnPeerDisconnect = faulty.WrapOnPeerDisconnect(s.OnPeerDisconnect)
+	}
+
+	t.Cleanup(func() {
+		s.Stop()
+		// Stop leaves connections open; their goroutines would otherwise
+		// pile up over a run and slow down the tests after
+		for _, peer := range s.peerList() {
+			peer.Close()
+		}
+		os.RemoveAll(s.StorageRoot)
+	})
+
+	return s
+}
+
+// startCluster starts n file servers on an in-memory network, each
+// connected to all the others, with faults injected by f unless it is nil
+func startCluster(t *testing.T, n int, f *p2p.FaultInjector) []*FileServer {
+	network := p2p.NewMemoryNetwork()
+	servers := make([]*FileServer, n)
+	addrs := []string{}
+
+	for i := range servers {
+		addr := fmt.Sprintf("node%d", i)
+		servers[i] = newMemoryServer(t, network, f, addr, addrs...)
+		// Discovery would race the bootstrap dials with crossing ones
+		servers[i].PeerDegree = -1
+		assert.NoError(t, servers[i].Transport.ListenAndAccept(), "Listening should not error")
+		addrs = append(addrs, addr)
+	}
+
+	for _, s := range servers {
+		s.bootstrapNetwork()
+		go s.loop()
+	}
+
+	waitForCluster(t, len(servers), func() bool {
+		for _, s := range servers {
+			s.peerLock.Lock()
+			connected := len(s.peers)
+			s.peerLock.Unlock()
+			if connected != n-1 {
+				return false
+			}
+		}
+		return true
+	}, "cluster should be fully connected")
+
+	return servers
+}
+
+// clusterTimeout is how long a condition over a cluster of n nodes may
+// take to hold. Every node adds probes, gossip and rebalancing the others
+// keep up with, which slows them all down under the race detector.
+func clusterTimeout(n int) time.Duration {
+	return 5*time.Second + time.Duration(n)*time.Second
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+
+	waitForCluster(t, 0, cond, msg)
+}
+
+// waitForCluster polls a condition over a cluster of n nodes until it
+// holds, failing the test after clusterTimeout(n)
+func waitForCluster(t *testing.T, n int, cond func() bool, msg string) {
+	t.Helper()
+
+	deadline := time.Now().Add(clusterTimeout(n))
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// holders returns the servers that hold the replica of a key stored by owner
+func holders(owner *FileServer, key string, servers []*FileServer) []*FileServer {
+	name := owner.hashObjectKey(key)
+	held := []*FileServer{}
+	for _, s := range servers {
+		if s != owner && s.store.Has(owner.ID, name) {
+			held = append(held, s)
+		}
+	}
+	return held
+}
+
+// ringOwners returns the servers the ring of s places the replicas of a
+// key stored by s on
+func ringOwners(s *FileServer, key string, servers []*FileServer) []*FileServer {
+	owners := []*FileServer{}
+	for _, c := range s.owners(s.ID, s.hashObjectKey(key)) {
+		for _, other := range servers {
+			if other.nodeID() == c.ID {
+				owners = append(owners, other)
+			}
+		}
+	}
+	return owners
+}
+
+func TestFileServerMemoryNetwork(t *testing.T) {
+	servers := startSettledCluster(t, 12)
+	s := servers[0]
+	key := "picture.png"
+	data := []byte("distributed file system data")
+
+	assert.NoError(t, s.Store(key, bytes.NewReader(data)), "Store should not error")
+
+	owners := ringOwners(s, key, servers)
+	assert.Len(t, owners, defaultReplicationFactor, "Ring should pick the replication factor of owners")
+	assertReplicas(t, s, key, true, owners...)
+
+	// A replica placed while a node was falsely suspected moves back
+	// once the ring settles
+	waitForCluster(t, len(servers), func() bool {
+		owners = ringOwners(s, key, servers)
+		held := holders(s, key, servers)
+		if len(owners) != defaultReplicationFactor || len(held) != len(owners) {
+			return false
+		}
+		for _, o := range owners {
+			if !slices.Contains(held, o) {
+				return false
+			}
+		}
+		return true
+	}, "only the owners should hold a replica")
+
+	// Drop the local copy so Get has to fetch it from the network
+	assertFetch(t, s, key, data)
+
+	assert.NoError(t, s.Delete(key), "Delete should not error")
+	assertReplicas(t, s, key, false, owners...)
+}
+
+func TestLegacyKeyNameFallback(t *testing.T) {
+	servers := startSettledCluster(t, 4)
+	s := servers[0]
+	s.WriteConsistency = ConsistencyAll
+	key := "legacy.txt"
+	data := []byte("stored before keyed hashing")
+
+	// Replicate the object under the unkeyed name older nodes used
+	legacy := hashKey(key)
+	encKey, err := s.newDataKey(legacy)
+	assert.NoError(t, err, "Creating a data key should not error")
+	replica := new(bytes.Buffer)
+	_, err = s.encryptReplica(encKey, data, replica)
+	assert.NoError(t, err, "Encrypting the replica should not error")
+	prov := newProvenance(s.IdentityKey, legacy, replica.Bytes())
+	assert.NoError(t, s.distribute(context.Background(), prov, replica.Bytes()), "Storing under the legacy name should not error")
+
+	r, err := s.Get(key)
+	if assert.NoError(t, err, "Get should fall back to the legacy name") {
+		b, err := io.ReadAll(r)
+		assert.NoError(t, err, "Reading the file should not error")
+		r.(io.Closer).Close()
+		assert.Equal(t, data, b, "Fetched file should match what was stored")
+	}
+
+	// Storing it again moves it to the keyed name
+	assert.NoError(t, s.Store(key, bytes.NewReader([]byte("stored again"))), "Store should not error")
+	waitForCluster(t, len(servers), func() bool {
+		for _, other := range servers[1:] {
+			if other.store.Has(s.ID, legacy) {
+				return false
+			}
+		}
+		return true
+	}, "replicas under the legacy name should be deleted")
+
+	assert.NoError(t, s.Delete(key), "Delete should not error")
+	_, err = s.Get(key)
+	assert.Error(t, err, "Deleted file should not come back under the legacy name")
+}
+
+func TestLocalCopyIsNotServed(t *testing.T) {
+	servers := startSettledCluster(t, 4)
+	s, spy := servers[0], servers[1]
+	key := "payroll.xlsx"
+	assert.NoError(t, s.Store(key, bytes.NewReader([]byte("salary figures"))), "Store should not error")
+
+	peer, ok := spy.peer(s.nodeID())
+	assert.True(t, ok, "Spy should be connected to the owner")
+	ask := func(payload func(reqID uint64) any) MessageResponse {
+		response := make(chan MessageResponse, 1)
+		reqID := spy.expectResponse(peer, response)
+		assert.NoError(t, spy.send(peer, &Message{Payload: payload(reqID)}), "Sending should not error")
+		resp, err := spy.awaitResponse(context.Background(), reqID, response)
+		assert.NoError(t, err, "Owner should answer")
+		return resp
+	}
+
+	// The owner's local copy is under the plaintext key in its namespace
+	stream, err := peer.OpenStream()
+	assert.NoError(t, err, "Opening a stream should not error")
+	resp := ask(func(reqID uint64) any {
+		return MessageGetFile{RequestID: reqID, ID: s.ID, Key: key, StreamID: stream.ID()}
+	})
+	assert.Equal(t, StatusNotFound, resp.Status, "Local copy should not be served")
+
+	resp = ask(func(reqID uint64) any {
+		return MessageGetMeta{RequestID: reqID, ID: s.ID, Key: key}
+	})
+	assert.Equal(t, StatusNotFound, resp.Status, "Local copy should not be reported")
+
+	for _, c := range spy.findProviders(context.Background(), s.ID, key) {
+		assert.NotEqual(t, s.nodeID(), c.ID, "Owner should not provide its local copy")
+	}
+
+	// The replicas, under the hashed name, are still served
+	assertFetch(t, s, key, []byte("salary figures"))
+}
+
+func TestEncryptedLocalCopyHidesItsKey(t *testing.T) {
+	servers := startCluster(t, 4, nil)
+	s := servers[0]
+	s.EncryptAtRest = true
+	key := "payroll.xlsx"
+	data := []byte("salaries")
+
+	assert.NoError(t, s.Store(key, bytes.NewReader(data)), "Store should not error")
+
+	// Nothing under the storage root names the file
+	err := filepath.WalkDir(s.StorageRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		assert.False(t, bytes.Contains(b, []byte(key)), "%s should not hold the file's key", path)
+		return nil
+	})
+	assert.NoError(t, err, "Walking the storage root should not error")
+
+	_, err = s.readLocal(key)
+	assert.NoError(t, err, "Local copy should verify")
+	assertFetch(t, s, key, data)
+}
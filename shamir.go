@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Shamir secret sharing over GF(256). Every byte of the secret is the
+// constant term of its own random polynomial of degree threshold-1, and a
+// share is the x coordinate followed by the polynomials evaluated at x.
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	// Powers of the generator 0x03 modulo the AES polynomial x^8+x^4+x^3+x+1
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+// gfMul multiplies two elements of GF(256)
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfDiv divides two elements of GF(256); b must not be zero
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// splitSecret splits secret into n shares, any threshold of which can
+// reconstruct it with combineShares
+func splitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("invalid share parameters: need 2 <= threshold (%d) <= shares (%d) <= 255", threshold, n)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coeffs := make([]byte, threshold)
+	for b, v := range secret {
+		coeffs[0] = v
+		if _, err := io.ReadFull(rand.Reader, coeffs[1:]); err != nil {
+			return nil, err
+		}
+
+		for _, share := range shares {
+			// Horner's method from the highest coefficient down
+			x, y := share[0], byte(0)
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coeffs[c]
+			}
+			share[b+1] = y
+		}
+	}
+
+	return shares, nil
+}
+
+// combineShares reconstructs a secret from shares made by splitSecret.
+// Given fewer shares than the threshold it returns an unrelated value.
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are required")
+	}
+
+	size := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != size || size < 2 {
+			return nil, errors.New("shares have inconsistent lengths")
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, fmt.Errorf("invalid or duplicate share index %d", share[0])
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, size-1)
+	for i, si := range shares {
+		// Lagrange basis polynomial for share i evaluated at x = 0
+		basis := byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			basis = gfMul(basis, gfDiv(sj[0], sj[0]^si[0]))
+		}
+
+		for b := range secret {
+			secret[b] ^= gfMul(si[b+1], basis)
+		}
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGFArithmetic(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for _, b := range []byte{1, 2, 3, 0x53, 0xca, 0xff} {
+			product := gfMul(byte(a), b)
+			assert.Equal(t, byte(a), gfDiv(product, b), "Division should undo multiplication")
+		}
+	}
+
+	// Known product from the AES specification
+	assert.Equal(t, byte(0x01), gfMul(0x53, 0xca), "0x53 and 0xca should be inverses")
+}
+
+func TestSplitAndCombineShares(t *testing.T) {
+	secret := newEncryptionKey()
+
+	shares, err := splitSecret(secret, 5, 3)
+	assert.NoError(t, err, "Splitting should not error")
+	assert.Len(t, shares, 5, "Should create the requested number of shares")
+
+	// Any three shares recover the secret
+	for _, subset := range [][]int{{0, 1, 2}, {0, 2, 4}, {4, 3, 1}, {0, 1, 2, 3, 4}} {
+		var parts [][]byte
+		for _, i := range subset {
+			parts = append(parts, shares[i])
+		}
+
+		got, err := combineShares(parts)
+		assert.NoError(t, err, "Combining should not error")
+		assert.Equal(t, secret, got, "Shares %v should recover the secret", subset)
+	}
+
+	// Two shares reveal nothing useful
+	got, err := combineShares(shares[:2])
+	assert.NoError(t, err, "Combining below threshold should not error")
+	assert.NotEqual(t, secret, got, "Fewer shares than the threshold should not recover the secret")
+
+	_, err = combineShares([][]byte{shares[0], shares[0]})
+	assert.Error(t, err, "Duplicate shares should be rejected")
+
+	_, err = splitSecret(secret, 2, 3)
+	assert.Error(t, err, "Threshold above share count should be rejected")
+}
+
+func TestSplitAndRecoverKey(t *testing.T) {
+	key := newEncryptionKey()
+
+	shares, err := splitKey(key, 4, 2)
+	assert.NoError(t, err, "Splitting should not error")
+
+	got, err := recoverKey([]string{shares[3], shares[1]})
+	assert.NoError(t, err, "Recovering should not error")
+	assert.Equal(t, key, got, "Shares should recover the key")
+
+	_, err = recoverKey(shares[:1])
+	assert.Error(t, err, "Too few shares should be rejected")
+
+	others, err := splitKey(newEncryptionKey(), 4, 2)
+	assert.NoError(t, err, "Splitting should not error")
+	_, err = recoverKey([]string{shares[0], others[1]})
+	assert.Error(t, err, "Shares of different keys should be rejected")
+
+	// A share must not let its holder check a guessed key
+	hash := sha256.Sum256(key)
+	for _, share := range shares {
+		assert.NotContains(t, share, hex.EncodeToString(hash[:4]), "Share should not carry a fingerprint of the key")
+	}
+}
+
+func TestKeyCommandSplitAndRecover(t *testing.T) {
+	root := "test_keyring_escrow"
+	defer os.RemoveAll(root)
+	t.Setenv("DRIFT_PASSPHRASE", "")
+	t.Setenv("DRIFT_KEYRING_PASSPHRASE", "keyring secret")
+
+	key := newEncryptionKey()
+	assert.NoError(t, NewKeyring(root).SetClusterKey(key, "keyring secret"), "Storing cluster key should not error")
+
+	inside := NewKeyring(root).path("shares")
+	err := runKeyCommand([]string{"split", "-root", root, "-n", "3", "-k", "2", "-out", inside})
+	assert.Error(t, err, "Split command should not write shares next to the key")
+	assert.NoDirExists(t, inside, "No shares should be written inside the storage root")
+
+	shares := "test_keyring_shares"
+	defer os.RemoveAll(shares)
+	assert.NoError(t, runKeyCommand([]string{"split", "-root", root, "-n", "3", "-k", "2", "-out", shares}), "Split command should not error")
+
+	recovered := "test_keyring_recovered"
+	defer os.RemoveAll(recovered)
+
+	t.Setenv("DRIFT_KEYRING_PASSPHRASE", "")
+	err = runKeyCommand([]string{"recover", "-root", recovered, shares + "/share-1.txt", shares + "/share-3.txt"})
+	assert.Error(t, err, "Recover command should not store the key without a passphrase to seal it")
+	assert.NoDirExists(t, recovered, "Nothing should be written without a passphrase")
+
+	t.Setenv("DRIFT_KEYRING_PASSPHRASE", "another secret")
+	err = runKeyCommand([]string{"recover", "-root", recovered, shares + "/share-1.txt", shares + "/share-3.txt"})
+	assert.NoError(t, err, "Recover command should not error")
+
+	got, err := NewKeyring(recovered).ClusterKey("another secret")
+	assert.NoError(t, err, "Recovered cluster key should be stored")
+	assert.Equal(t, key, got, "Recovered cluster key should match the original")
+}
+
+func TestEncryptionKeyIsStoredForEscrow(t *testing.T) {
+	root := "test_keyring_generated"
+	defer os.RemoveAll(root)
+	t.Setenv("DRIFT_PASSPHRASE", "")
+	t.Setenv("DRIFT_KEYRING_PASSPHRASE", "keyring secret")
+
+	key := encryptionKey(root)
+	assert.Equal(t, key, encryptionKey(root), "Generated key should be reused on restart")
+
+	stored, err := NewKeyring(root).ClusterKey("keyring secret")
+	assert.NoError(t, err, "Generated key should be stored in the keyring")
+	assert.Equal(t, key, stored, "Stored key should be the generated key")
+
+	_, err = NewKeyring(root).ClusterKey("wrong secret")
+	assert.Error(t, err, "Stored key should not unseal with another passphrase")
+
+	b, err := os.ReadFile(NewKeyring(root).path("cluster.key.json"))
+	assert.NoError(t, err, "Reading the keyring entry should not error")
+	assert.False(t, bytes.Contains(b, []byte(base64.StdEncoding.EncodeToString(key))), "Cluster key should not be stored unsealed")
+
+	shares := "test_keyring_generated_shares"
+	defer os.RemoveAll(shares)
+	assert.NoError(t, runKeyCommand([]string{"split", "-root", root, "-n", "3", "-k", "2", "-out", shares}), "Splitting the generated key should not error")
+}
+
+func TestEncryptionKeyIsNotStoredWithoutPassphrase(t *testing.T) {
+	root := "test_keyring_ephemeral"
+	defer os.RemoveAll(root)
+	t.Setenv("DRIFT_PASSPHRASE", "")
+	t.Setenv("DRIFT_KEYRING_PASSPHRASE", "")
+
+	assert.NoError(t, validateKey(encryptionKey(root)), "Generated key should be a valid encryption key")
+	assert.NoFileExists(t, NewKeyring(root).path("cluster.key.json"), "Key should not be written without a passphrase to seal it")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// sharedKeyPrefix keeps the names of shared objects apart from the names
+// of files stored with Store under the same key
+const sharedKeyPrefix = "shared/"
+
+// maxShareHeaderSize bounds the header read in front of a shared object
+const maxShareHeaderSize = 1024 * 1024
+
+// ErrNotRecipient is returned when opening a shared object that was not
+// encrypted for this node
+var ErrNotRecipient = errors.New("not a recipient of shared object")
+
+// ShareRef identifies a file shared with other nodes. The owner hands it
+// to recipients, who pass it to GetShared.
+type ShareRef struct {
+	Owner  string
+	Key    string
+	Author ed25519.PublicKey
+}
+
+// wrappedKey is the object's data key encrypted for a single recipient
+type wrappedKey struct {
+	Recipient []byte
+	Key       []byte
+}
+
+// shareHeader is written in front of the ciphertext of a shared object
+type shareHeader struct {
+	Ephemeral  []byte
+	Recipients []wrappedKey
+}
+
+// keyEncryptionCipher returns the AEAD that wraps the data key for one
+// recipient, keyed by the X25519 secret between the ephemeral key and it
+func keyEncryptionCipher(secret []byte, ephemeral []byte, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	kek, err := hkdf.Key(sha256.New, secret, salt, "drift share key", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealShare encrypts src for the given recipients and writes the header
+// followed by the ciphertext to dst
+func sealShare(recipients []*ecdh.PublicKey, src io.Reader, dst io.Writer) error {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	dataKey := newEncryptionKey()
+	header := shareHeader{Ephemeral: ephemeral.PublicKey().Bytes()}
+	seen := make(map[string]bool)
+
+	for _, pub := range recipients {
+		if seen[string(pub.Bytes())] {
+			continue
+		}
+		seen[string(pub.Bytes())] = true
+
+		secret, err := ephemeral.ECDH(pub)
+		if err != nil {
+			return err
+		}
+
+		aead, err := keyEncryptionCipher(secret, header.Ephemeral, pub.Bytes())
+		if err != nil {
+			return err
+		}
+
+		// Every key encryption key is unique, so a zero nonce is safe
+		nonce := make([]byte, aead.NonceSize())
+		header.Recipients = append(header.Recipients, wrappedKey{
+			Recipient: pub.Bytes(),
+			Key:       aead.Seal(nil, nonce, dataKey, nil),
+		})
+	}
+
+	b, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(dst, binary.LittleEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	if _, err := dst.Write(b); err != nil {
+		return err
+	}
+
+	_, err = copyEncrypt(dataKey, src, dst)
+	return err
+}
+
+// openShare reads the header of a shared object from src and returns a
+// reader that decrypts the rest of it with the recipient's key
+func openShare(priv *ecdh.PrivateKey, src io.Reader) (io.Reader, error) {
+	var n uint32
+	if err := binary.Read(src, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > maxShareHeaderSize {
+		return nil, fmt.Errorf("share header too large: %d bytes", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(src, b); err != nil {
+		return nil, err
+	}
+
+	var header shareHeader
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, err
+	}
+
+	self := priv.PublicKey().Bytes()
+	for _, wk := range header.Recipients {
+		if !bytes.Equal(wk.Recipient, self) {
+			continue
+		}
+
+		ephemeral, err := ecdh.X25519().NewPublicKey(header.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err := priv.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := keyEncryptionCipher(secret, header.Ephemeral, self)
+		if err != nil {
+			return nil, err
+		}
+
+		dataKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), wk.Key, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return newDecryptReader(dataKey, src)
+	}
+
+	return nil, ErrNotRecipient
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealAndOpenShare(t *testing.T) {
+	alice, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+	bob, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+	eve, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+
+	plaintext := []byte("This file is only for alice and bob")
+
+	var sealed bytes.Buffer
+	err = sealShare([]*ecdh.PublicKey{alice.PublicKey(), bob.PublicKey(), bob.PublicKey()}, bytes.NewReader(plaintext), &sealed)
+	assert.NoError(t, err, "Sealing should not error")
+	assert.False(t, bytes.Contains(sealed.Bytes(), plaintext), "Sealed object should not contain the plaintext")
+
+	for _, priv := range []*ecdh.PrivateKey{alice, bob} {
+		r, err := openShare(priv, bytes.NewReader(sealed.Bytes()))
+		assert.NoError(t, err, "Recipient should open the share")
+
+		got, err := io.ReadAll(r)
+		assert.NoError(t, err, "Reading the share should not error")
+		assert.Equal(t, plaintext, got, "Recipient should read the original data")
+	}
+
+	_, err = openShare(eve, bytes.NewReader(sealed.Bytes()))
+	assert.ErrorIs(t, err, ErrNotRecipient, "Other nodes should not open the share")
+}
+
+func TestOpenShareTamperedKey(t *testing.T) {
+	alice, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+
+	var sealed bytes.Buffer
+	err = sealShare([]*ecdh.PublicKey{alice.PublicKey()}, bytes.NewReader([]byte("data")), &sealed)
+	assert.NoError(t, err, "Sealing should not error")
+
+	// Flip a bit inside the header, which holds the wrapped key
+	b := sealed.Bytes()
+	b[len(b)-40] ^= 0x01
+
+	_, err = openShare(alice, bytes.NewReader(b))
+	assert.Error(t, err, "A tampered header should not open")
+}
+
+func TestGetSharedVerifiesLocalCopy(t *testing.T) {
+	servers := startCluster(t, 4, nil)
+	owner, recipient := servers[0], servers[1]
+	data := []byte("shared and then tampered with")
+
+	ref, err := owner.StoreFor("shared.txt", bytes.NewReader(data), recipient.ExchangeKey.PublicKey())
+	assert.NoError(t, err, "StoreFor should not error")
+
+	for range 2 {
+		r, err := recipient.GetShared(ref)
+		if !assert.NoError(t, err, "GetShared should not error") {
+			return
+		}
+		got, err := io.ReadAll(r)
+		assert.NoError(t, err, "Reading the shared file should not error")
+		r.(io.Closer).Close()
+		assert.Equal(t, data, got, "GetShared should return the shared file")
+
+		// Swap the copy on disk; the next read has to fetch it again
+		_, err = recipient.store.Write(ref.Owner, ref.Key, bytes.NewReader([]byte("substituted")))
+		assert.NoError(t, err, "Tampering with the local copy should not error")
+	}
+}
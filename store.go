@@ -1,13 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -64,6 +68,25 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 	}
 }
 
+// ObjectMeta holds the metadata kept next to a stored object
+type ObjectMeta struct {
+	// Key is the key the object is stored under, set by WriteMeta so the
+	// store can be listed. It is only recorded for objects stored under
+	// the name their provenance was signed for, so a node's local copies,
+	// stored under their plaintext key, keep that key off the disk.
+	Key        string      `json:"key,omitempty"`
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// Local is the originating node's signature of its local copy, which
+	// unlike the replicas may be stored decrypted
+	Local *Provenance `json:"local,omitempty"`
+}
+
+// ObjectRef names a stored object by the ID and key it is stored under
+type ObjectRef struct {
+	ID  string
+	Key string
+}
+
 // StoreOpts contains options for the store
 type StoreOpts struct {
 	// Root is the folder name containing all files
@@ -122,6 +145,47 @@ func (s *Store) Delete(id string, key string) error {
 	return os.RemoveAll(firstPathNameWithRoot)
 }
 
+// SecureDelete overwrites a file and its metadata before removing them,
+// so the contents do not linger in unallocated blocks
+func (s *Store) SecureDelete(id string, key string) error {
+	if !s.Has(id, key) {
+		return fmt.Errorf("file with key %s does not exist", key)
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+
+	if err := overwriteFile(fullPathWithRoot); err != nil {
+		return err
+	}
+	if err := overwriteFile(s.metaPath(id, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return s.Delete(id, key)
+}
+
+// overwriteFile replaces the contents of a file with random bytes and
+// flushes them to disk
+func overwriteFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(f, rand.Reader, fi.Size()); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
 // Write writes data to the store
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 	return s.writeStream(id, key, r)
@@ -129,39 +193,47 @@ func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 
 // WriteDecrypt writes encrypted data to the store with decryption
 func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
+	return s.writeFile(id, key, func(w io.Writer) (int64, error) {
+		n, err := copyDecrypt(encKey, r, w)
+		return int64(n), err
+	})
 }
 
-// openFileForWriting opens a file for writing, creating directories as needed
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
+// writeFile writes an object through a temporary file that is renamed
+// into place, creating directories as needed, so readers never see a
+// partly written object and a failed write keeps the old one
+func (s *Store) writeFile(id string, key string, write func(w io.Writer) (int64, error)) (int64, error) {
 	pathKey := s.PathTransformFunc(key)
 	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
 	
 	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
+		return 0, err
+	}
+
+	f, err := os.CreateTemp(pathNameWithRoot, ".write-*")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return n, err
 	}
 
 	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 
-	return os.Create(fullPathWithRoot)
+	return n, os.Rename(f.Name(), fullPathWithRoot)
 }
 
 // writeStream writes data to a file stream
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-
-	return io.Copy(f, r)
+	return s.writeFile(id, key, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
 }
 
 // Read reads data from the store
@@ -199,4 +271,72 @@ func (s *Store) Size(id string, key string) (int64, error) {
 	}
 
 	return fi.Size(), nil
-}
\ No newline at end of file
+}
+
+// metaPath returns the path of the metadata kept next to an object
+func (s *Store) metaPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s.meta", s.Root, id, pathKey.FullPath())
+}
+
+// WriteMeta stores the metadata for an object
+func (s *Store) WriteMeta(id string, key string, meta ObjectMeta) error {
+	meta.Key = ""
+	if meta.Provenance != nil && meta.Provenance.Key == key {
+		meta.Key = key
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.metaPath(id, key), b, 0644)
+}
+
+// ReadMeta reads the metadata for an object
+func (s *Store) ReadMeta(id string, key string) (ObjectMeta, error) {
+	var meta ObjectMeta
+
+	b, err := os.ReadFile(s.metaPath(id, key))
+	if err != nil {
+		return meta, err
+	}
+
+	return meta, json.Unmarshal(b, &meta)
+}
+
+// List returns every object in the store that has metadata
+func (s *Store) List() ([]ObjectRef, error) {
+	refs := []ObjectRef{}
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".meta") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return err
+		}
+		id, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+
+		var meta ObjectMeta
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &meta); err != nil || len(meta.Key) == 0 {
+			return nil
+		}
+
+		refs = append(refs, ObjectRef{ID: id, Key: meta.Key})
+		return nil
+	})
+
+	return refs, err
+}
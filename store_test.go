@@ -247,4 +247,74 @@ func TestStoreLargeFile(t *testing.T) {
 	assert.Equal(t, largeData, readData, "Read data should match written data")
 	
 	reader.Close()
-}
\ No newline at end of file
+}
+
+func TestStoreMeta(t *testing.T) {
+	store := NewStore(StoreOpts{
+		Root:              "test_store_meta",
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	// Clean up after test
+	defer func() {
+		store.Clear()
+	}()
+
+	id := "test_id"
+	key := "test_key"
+
+	_, err := store.Write(id, key, bytes.NewReader([]byte("data")))
+	assert.NoError(t, err, "Write should not error")
+
+	prov := Provenance{Key: key, Size: 4, Timestamp: 42}
+	assert.NoError(t, store.WriteMeta(id, key, ObjectMeta{Provenance: &prov}), "WriteMeta should not error")
+
+	meta, err := store.ReadMeta(id, key)
+	assert.NoError(t, err, "ReadMeta should not error")
+	assert.Equal(t, &prov, meta.Provenance, "Metadata should round trip")
+	assert.Equal(t, key, meta.Key, "Metadata should record the key")
+
+	refs, err := store.List()
+	assert.NoError(t, err, "List should not error")
+	assert.Equal(t, []ObjectRef{{ID: id, Key: key}}, refs, "List should return objects with metadata")
+
+	// Metadata is removed along with the object
+	assert.NoError(t, store.Delete(id, key), "Delete should not error")
+	_, err = store.ReadMeta(id, key)
+	assert.Error(t, err, "Metadata should be gone after delete")
+}
+
+func TestStoreSecureDelete(t *testing.T) {
+	store := NewStore(StoreOpts{
+		Root:              "test_store_secure_delete",
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	// Clean up after test
+	defer func() {
+		store.Clear()
+	}()
+
+	id := "test_id"
+	key := "test_key"
+	data := []byte("This is sensitive test data")
+
+	_, err := store.Write(id, key, bytes.NewReader(data))
+	assert.NoError(t, err, "Write should not error")
+	assert.NoError(t, store.WriteMeta(id, key, ObjectMeta{}), "WriteMeta should not error")
+
+	// Overwriting keeps the size but replaces the contents
+	fullPath := store.Root + "/" + id + "/" + store.PathTransformFunc(key).FullPath()
+	assert.NoError(t, overwriteFile(fullPath), "Overwrite should not error")
+	_, reader, err := store.Read(id, key)
+	assert.NoError(t, err, "Read should not error")
+	overwritten, err := io.ReadAll(reader)
+	reader.Close()
+	assert.NoError(t, err, "Reading data should not error")
+	assert.Len(t, overwritten, len(data), "Overwrite should keep the file size")
+	assert.NotEqual(t, data, overwritten, "Overwrite should replace the contents")
+
+	assert.NoError(t, store.SecureDelete(id, key), "SecureDelete should not error")
+	assert.False(t, store.Has(id, key), "Store should not have the file after secure deletion")
+	assert.Error(t, store.SecureDelete(id, key), "SecureDelete should error for a missing file")
+}
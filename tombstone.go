@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+)
+
+const (
+	// tombstoneFolderName is the folder under the store root that keeps
+	// tombstones
+	tombstoneFolderName = "tombstones"
+	// maxTombstoneSkew is how far ahead of this node's clock a tombstone
+	// may be dated
+	maxTombstoneSkew = time.Minute
+)
+
+// ErrInvalidTombstone is returned when a delete was not signed by the
+// owner of the object or is dated too far in the future
+var ErrInvalidTombstone = errors.New("invalid tombstone")
+
+// Tombstone records that an object was deleted, so replicas that missed
+// the delete catch up and older copies are not taken back. It is signed
+// by the object's owner and travels with every delete.
+type Tombstone struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+	// Timestamp is when the object was deleted, on the node deleting it
+	Timestamp int64             `json:"timestamp"`
+	Secure    bool              `json:"secure,omitempty"`
+	Author    ed25519.PublicKey `json:"author"`
+	Signature []byte            `json:"signature"`
+}
+
+// newTombstone signs the deletion of the object stored under key by the
+// owner with the given identity key
+func newTombstone(priv ed25519.PrivateKey, key string, secure bool) Tombstone {
+	author := priv.Public().(ed25519.PublicKey)
+
+	t := Tombstone{
+		ID:        p2p.NodeIDFromKey(author),
+		Key:       key,
+		Timestamp: time.Now().UnixNano(),
+		Secure:    secure,
+		Author:    author,
+	}
+	t.Signature = ed25519.Sign(priv, t.signedBytes())
+
+	return t
+}
+
+// signedBytes returns the canonical encoding covered by the signature
+func (t Tombstone) signedBytes() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("drift-tombstone-v1")
+	binary.Write(buf, binary.BigEndian, uint32(len(t.ID)))
+	buf.WriteString(t.ID)
+	binary.Write(buf, binary.BigEndian, uint32(len(t.Key)))
+	buf.WriteString(t.Key)
+	binary.Write(buf, binary.BigEndian, t.Timestamp)
+	binary.Write(buf, binary.BigEndian, t.Secure)
+	return buf.Bytes()
+}
+
+// Verify checks that the tombstone was signed by the owner of the object,
+// whose node ID is the ID the object is stored under, and that it is not
+// dated too far in the future
+func (t Tombstone) Verify() error {
+	if len(t.Author) != ed25519.PublicKeySize || p2p.NodeIDFromKey(t.Author) != t.ID {
+		return fmt.Errorf("%w: not signed by the owner of (%s)", ErrInvalidTombstone, t.Key)
+	}
+	if !ed25519.Verify(t.Author, t.signedBytes(), t.Signature) {
+		return fmt.Errorf("%w: bad signature on (%s)", ErrInvalidTombstone, t.Key)
+	}
+	if t.Timestamp > time.Now().Add(maxTombstoneSkew).UnixNano() {
+		return fmt.Errorf("%w: (%s) is dated in the future", ErrInvalidTombstone, t.Key)
+	}
+	return nil
+}
+
+// tombstonePath returns the path of the tombstone of an object
+func (s *Store) tombstonePath(id string, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.Root, tombstoneFolderName, id, hex.EncodeToString(sum[:]))
+}
+
+// WriteTombstone records that an object was deleted
+func (s *Store) WriteTombstone(t Tombstone) error {
+	path := s.tombstonePath(t.ID, t.Key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0644)
+}
+
+// ReadTombstone reads the tombstone of an object
+func (s *Store) ReadTombstone(id string, key string) (Tombstone, error) {
+	var t Tombstone
+
+	b, err := os.ReadFile(s.tombstonePath(id, key))
+	if err != nil {
+		return t, err
+	}
+
+	return t, json.Unmarshal(b, &t)
+}
+
+// DeleteTombstone forgets that an object was deleted
+func (s *Store) DeleteTombstone(id string, key string) error {
+	return os.Remove(s.tombstonePath(id, key))
+}
+
+// Tombstones returns every tombstone in the store
+func (s *Store) Tombstones() ([]Tombstone, error) {
+	tombstones := []Tombstone{}
+	err := filepath.WalkDir(filepath.Join(s.Root, tombstoneFolderName), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var t Tombstone
+		if err := json.Unmarshal(b, &t); err != nil {
+			return nil
+		}
+
+		tombstones = append(tombstones, t)
+		return nil
+	})
+
+	return tombstones, err
+}
+
+// superseded reports whether this node holds a newer version of an
+// object, or deleted it later, than a replica signed at timestamp
+func (s *FileServer) superseded(id string, key string, timestamp int64) bool {
+	if meta, err := s.store.ReadMeta(id, key); err == nil && meta.Provenance != nil && meta.Provenance.Timestamp > timestamp {
+		return true
+	}
+	if t, err := s.store.ReadTombstone(id, key); err == nil && t.Timestamp >= timestamp {
+		return true
+	}
+	return false
+}
+
+// applyTombstone records the deletion of a replica and removes it, unless
+// the replica was stored again since or the tombstone does not verify. It
+// reports whether it removed one.
+func (s *FileServer) applyTombstone(t Tombstone) (bool, error) {
+	if err := t.Verify(); err != nil {
+		return false, err
+	}
+
+	if meta, err := s.store.ReadMeta(t.ID, t.Key); err == nil && meta.Provenance != nil && meta.Provenance.Timestamp > t.Timestamp {
+		return false, nil
+	}
+
+	if old, err := s.store.ReadTombstone(t.ID, t.Key); err != nil || old.Timestamp < t.Timestamp {
+		if err := s.store.WriteTombstone(t); err != nil {
+			return false, err
+		}
+	}
+
+	if !s.store.Has(t.ID, t.Key) {
+		return false, nil
+	}
+
+	del := s.store.Delete
+	if t.Secure {
+		del = s.store.SecureDelete
+	}
+	if err := del(t.ID, t.Key); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// purgeTombstones forgets the deletes older than TombstoneTTL. A replica
+// that missed a delete for longer can come back.
+func (s *FileServer) purgeTombstones() error {
+	tombstones, err := s.store.Tombstones()
+	if err != nil {
+		return err
+	}
+
+	expired := time.Now().Add(-s.AntiEntropy.TombstoneTTL).UnixNano()
+	for _, t := range tombstones {
+		if t.Timestamp < expired {
+			if err := s.store.DeleteTombstone(t.ID, t.Key); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("purging tombstone of (%s): %w", t.Key, err)
+			}
+		}
+	}
+	return nil
+}
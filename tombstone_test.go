@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/himanshuraimau/drift/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTombstoneSignAndVerify(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+
+	tombstone := newTombstone(priv, "object_key", false)
+	assert.Equal(t, p2p.NodeIDFromKey(priv.Public().(ed25519.PublicKey)), tombstone.ID, "Tombstone should name the owner's objects")
+	assert.NoError(t, tombstone.Verify(), "Fresh tombstone should verify")
+
+	forged := tombstone
+	forged.Secure = true
+	assert.ErrorIs(t, forged.Verify(), ErrInvalidTombstone, "Tampered fields should fail")
+
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err, "Generating a key should not error")
+	forged = newTombstone(otherPriv, "object_key", false)
+	forged.ID = tombstone.ID
+	forged.Signature = ed25519.Sign(otherPriv, forged.signedBytes())
+	assert.ErrorIs(t, forged.Verify(), ErrInvalidTombstone, "Another node's objects should fail")
+
+	future := tombstone
+	future.Timestamp = time.Now().Add(time.Hour).UnixNano()
+	future.Signature = ed25519.Sign(priv, future.signedBytes())
+	assert.ErrorIs(t, future.Verify(), ErrInvalidTombstone, "Tombstone dated in the future should fail")
+}
+
+func TestForgedDeleteIsRejected(t *testing.T) {
+	servers := startSettledCluster(t, 4)
+	s := servers[0]
+	name := s.hashObjectKey("forged")
+
+	s.WriteConsistency = ConsistencyAll
+	assert.NoError(t, s.Store("forged", bytes.NewReader([]byte("not yours to delete"))), "Store should not error")
+	owners := ringOwners(s, "forged", servers)
+
+	// Another node signs a delete of an object it does not own
+	mallory := servers[1]
+	forged := newTombstone(mallory.IdentityKey, name, false)
+	forged.ID = s.ID
+	forged.Signature = ed25519.Sign(mallory.IdentityKey, forged.signedBytes())
+	entry := SyncEntry{
+		ID:        forged.ID,
+		Key:       forged.Key,
+		Timestamp: forged.Timestamp,
+		Author:    forged.Author,
+		Deleted:   true,
+		Signature: forged.Signature,
+	}
+
+	for _, owner := range owners {
+		err := owner.handleMessageDeleteFile(mallory.nodeID(), MessageDeleteFile{Tombstone: forged})
+		assert.ErrorIs(t, err, ErrInvalidTombstone, "Forged delete should be rejected")
+
+		// A deletion is pulled from the entry alone, whoever sent it
+		err = owner.pull(context.Background(), nil, entry)
+		assert.ErrorIs(t, err, ErrInvalidTombstone, "Forged tombstone should not be pulled")
+
+		_, err = owner.store.ReadTombstone(s.ID, name)
+		assert.Error(t, err, "Forged tombstone should not be stored")
+	}
+	assertReplicas(t, s, "forged", true, owners...)
+}